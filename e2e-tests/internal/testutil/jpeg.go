@@ -38,7 +38,8 @@ func ContainsMetadata(respBody []byte, metadataType string) (bool, error) {
 		}
 	case "icc":
 		// ICC = APP2 (0xE2) with "ICC_PROFILE\x00" prefix
-		if bytes.Contains(respBody, []byte("ICC_PROFILE\x00")) || containsMarker(respBody, 0xE2) {
+		// Other APP2 payloads such as MPF are not ICC
+		if bytes.Contains(respBody, []byte("ICC_PROFILE\x00")) {
 			return true, nil
 		}
 	case "comment", "com":
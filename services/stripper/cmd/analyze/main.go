@@ -0,0 +1,95 @@
+// Command analyze scans JPEG files for data that may hide a payload and
+// exits with status 1 when any file reaches the given severity, so scripts
+// can quarantine them.
+//
+//	analyze [-json] [-fail-on low|medium|high] file...
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/jpegstrip"
+)
+
+// Exit statuses
+const (
+	exitClean   = 0
+	exitSuspect = 1 // a file reached the -fail-on severity
+	exitError   = 2 // bad usage, or a file could not be read or parsed
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "print one JSON object per file")
+	failOn := flags.String("fail-on", "medium", "lowest severity that fails: low, medium or high")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+
+	threshold := jpegstrip.Severity(*failOn)
+	switch threshold {
+	case jpegstrip.SeverityLow, jpegstrip.SeverityMedium, jpegstrip.SeverityHigh:
+	default:
+		fmt.Fprintf(stderr, "analyze: -fail-on must be low, medium or high\n")
+		return exitError
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintf(stderr, "usage: analyze [-json] [-fail-on low|medium|high] file...\n")
+		return exitError
+	}
+
+	status := exitClean
+	for _, path := range flags.Args() {
+		analysis, err := analyzeFile(path)
+		if err != nil {
+			fmt.Fprintf(stderr, "analyze: %s: %v\n", path, err)
+			status = exitError
+			continue
+		}
+
+		if *asJSON {
+			json.NewEncoder(stdout).Encode(struct {
+				File string `json:"file"`
+				*jpegstrip.Analysis
+			}{path, analysis})
+		} else {
+			printAnalysis(stdout, path, analysis)
+		}
+
+		if status == exitClean && analysis.Severity != "" && analysis.Severity.AtLeast(threshold) {
+			status = exitSuspect
+		}
+	}
+	return status
+}
+
+func analyzeFile(path string) (*jpegstrip.Analysis, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return jpegstrip.Analyze(f)
+}
+
+func printAnalysis(w io.Writer, path string, a *jpegstrip.Analysis) {
+	if len(a.Anomalies) == 0 {
+		fmt.Fprintf(w, "%s: clean\n", path)
+		return
+	}
+
+	fmt.Fprintf(w, "%s: %s\n", path, a.Severity)
+	for _, an := range a.Anomalies {
+		fmt.Fprintf(w, "  %-6s %s at %d: %s\n", an.Severity, an.Kind, an.Offset, an.Detail)
+	}
+}
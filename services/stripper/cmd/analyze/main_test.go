@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return path
+	}
+
+	clean := write("clean.jpg", testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22})))
+	vendor := write("vendor.jpg", testutil.MakeJPEG(testutil.MakeSegment(0xE9, []byte("vendor")), testutil.MakeSOS([]byte{0x11})))
+	polyglot := write("polyglot.jpg", append(testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11})), "PK\x03\x04zip"...))
+
+	t.Run("Clean and suspect files", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{clean, polyglot}, &stdout, &stderr); code != exitSuspect {
+			t.Fatalf("exit status %d, stderr %q", code, stderr.String())
+		}
+		out := stdout.String()
+		if !strings.Contains(out, clean+": clean") || !strings.Contains(out, polyglot+": high") || !strings.Contains(out, "trailer at") {
+			t.Fatalf("unexpected output %q", out)
+		}
+	})
+
+	t.Run("fail-on decides what fails", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{vendor}, &stdout, &stderr); code != exitClean {
+			t.Fatalf("a low severity failed with the default threshold: %d", code)
+		}
+		if code := run([]string{"-fail-on", "low", vendor}, &stdout, &stderr); code != exitSuspect {
+			t.Fatalf("expected -fail-on low to fail, got %d", code)
+		}
+	})
+
+	t.Run("JSON output", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		run([]string{"-json", polyglot}, &stdout, &stderr)
+
+		var got struct {
+			File     string `json:"file"`
+			Severity string `json:"severity"`
+		}
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil || got.File != polyglot || got.Severity != "high" {
+			t.Fatalf("unexpected output %q, %v", stdout.String(), err)
+		}
+	})
+
+	t.Run("Unreadable files and bad usage", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{write("text.jpg", []byte("hello"))}, &stdout, &stderr); code != exitError {
+			t.Fatalf("expected an error status, got %d", code)
+		}
+		if code := run([]string{"-fail-on", "critical", clean}, &stdout, &stderr); code != exitError {
+			t.Fatalf("expected an error status, got %d", code)
+		}
+		if code := run(nil, &stdout, &stderr); code != exitError {
+			t.Fatalf("expected an error status, got %d", code)
+		}
+	})
+}
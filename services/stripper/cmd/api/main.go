@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/daria/exif-cleaner/services/stripper/internal/jpegstrip"
@@ -19,43 +22,105 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status":"ok"}`))
 }
 
-func StripHandler(w http.ResponseWriter, r *http.Request) {
+// Checks that the request body looks like a JPEG and returns a reader over
+// all of it. On failure the response has already been written.
+func readJPEGBody(w http.ResponseWriter, r *http.Request) (io.Reader, bool) {
 	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
-	defer r.Body.Close()
 
 	header := make([]byte, 512)
 	n, err := io.ReadFull(r.Body, header)
 	if err != nil && err != io.ErrUnexpectedEOF {
-		http.Error(w, "failed to read file header", http.StatusBadRequest)
-		return
+		writeProblem(w, &jpegstrip.Error{Offset: -1, Reason: jpegstrip.ReasonRead, Err: err})
+		return nil, false
 	}
 
 	contentType := http.DetectContentType(header[:n])
 	if contentType != "image/jpeg" {
 		http.Error(w, fmt.Sprintf("expected JPEG, got %s", contentType), http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	return io.MultiReader(bytes.NewReader(header[:n]), r.Body), true
+}
+
+func StripHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	fullReader, ok := readJPEGBody(w, r)
+	if !ok {
 		return
 	}
 
 	q := r.URL.Query()
 	metadataTypes := q["metadataType"]
 
-	metadataRules := make(map[byte][]byte, len(metadataTypes))
+	policy := jpegstrip.NewPolicy()
 
+	// A type that does nothing would hand back an image that only looks clean
+	var unsupported []string
 	for _, t := range metadataTypes {
-		marker, prefix := jpegstrip.MarkerFor(t)
-		if marker != 0 {
-			metadataRules[marker] = prefix
+		if !policy.AddType(t) {
+			unsupported = append(unsupported, t)
+		}
+	}
+	if len(unsupported) > 0 {
+		writeUnsupported(w, unsupported)
+		return
+	}
+
+	switch q.Get("orientation") {
+	case "", "drop":
+		policy.Orientation = jpegstrip.OrientationDrop
+	case "keep":
+		policy.Orientation = jpegstrip.OrientationKeep
+	case "bake":
+		policy.Orientation = jpegstrip.OrientationBake
+	default:
+		writeInvalidParameter(w, "orientation", "orientation must be one of drop, keep or bake")
+		return
+	}
+
+	switch q.Get("layout") {
+	case "", "keep":
+		policy.Layout = jpegstrip.LayoutKeep
+	case "canonical":
+		policy.Layout = jpegstrip.LayoutCanonical
+	default:
+		writeInvalidParameter(w, "layout", "layout must be keep or canonical")
+		return
+	}
+
+	// Segments the "all" allowlist may keep next to the ones needed to decode
+	for _, k := range q["keep"] {
+		switch strings.ToLower(k) {
+		case "jfif":
+			policy.KeepJFIF = true
+		case "icc":
+			policy.KeepICC = true
+		default:
+			writeInvalidParameter(w, "keep", "keep must be jfif or icc")
+			return
 		}
 	}
 
-	fullReader := io.MultiReader(bytes.NewReader(header[:n]), r.Body)
+	policy.Mode, ok = jpegstrip.ParseModeFor(q.Get("mode"))
+	if !ok {
+		writeInvalidParameter(w, "mode", "mode must be one of default, strict or lenient")
+		return
+	}
 
 	var buf bytes.Buffer
-	if err := jpegstrip.Strip(fullReader, &buf, metadataRules); err != nil {
-		http.Error(w, "failed to process JPEG", http.StatusBadRequest)
+	repairs, err := jpegstrip.StripWithRepairs(fullReader, &buf, policy)
+	if err != nil {
+		writeProblem(w, err)
 		return
 	}
 
+	// The body is the image, so what was repaired goes in a header
+	if len(repairs) > 0 {
+		b, _ := json.Marshal(repairs)
+		w.Header().Set("X-Repairs", string(b))
+	}
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
 
@@ -64,6 +129,133 @@ func StripHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Answers 422 with the metadata types the stripper doesn't know
+func writeUnsupported(w http.ResponseWriter, types []string) {
+	sendProblem(w, problem{
+		Type:        "about:blank",
+		Title:       "Unsupported metadata types",
+		Status:      http.StatusUnprocessableEntity,
+		Detail:      "unsupported metadata types: " + strings.Join(types, ", "),
+		Unsupported: types,
+	})
+}
+
+// Answers 400 for a query parameter with a value the handler doesn't know
+func writeInvalidParameter(w http.ResponseWriter, name, detail string) {
+	sendProblem(w, problem{
+		Type:      "about:blank",
+		Title:     "Invalid parameter",
+		Status:    http.StatusBadRequest,
+		Detail:    detail,
+		Reason:    "invalid_parameter",
+		Parameter: name,
+	})
+}
+
+// problem is an RFC 9457 problem details body, extended with where in the
+// JPEG things went wrong
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Reason string `json:"reason,omitempty"`
+	Offset *int64 `json:"offset,omitempty"`
+	Marker string `json:"marker,omitempty"`
+
+	Unsupported []string `json:"unsupported,omitempty"` // metadata types the request named
+	Parameter   string   `json:"parameter,omitempty"`   // query parameter with a bad value
+}
+
+// Answers with the problem details of a failed Strip or Inspect
+func writeProblem(w http.ResponseWriter, err error) {
+	p := problem{
+		Type:   "about:blank",
+		Title:  "Failed to process JPEG",
+		Status: http.StatusBadRequest,
+		Detail: err.Error(),
+	}
+
+	var e *jpegstrip.Error
+	if errors.As(err, &e) {
+		p.Reason = string(e.Reason)
+		if e.Offset >= 0 {
+			p.Offset = &e.Offset
+		}
+		if e.Marker != 0 {
+			p.Marker = fmt.Sprintf("0x%02X", e.Marker)
+		}
+		// Only a failing writer is our fault, the rest is in the upload. A
+		// file over the limits is well formed, just more than we'll handle.
+		switch {
+		case e.Reason == jpegstrip.ReasonWrite:
+			p.Status = http.StatusInternalServerError
+		case errors.Is(err, jpegstrip.ErrLimitExceeded):
+			p.Status = http.StatusUnprocessableEntity
+			p.Title = "JPEG exceeds a resource limit"
+		}
+	}
+
+	// The body was cut off at the upload limit
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		p.Status = http.StatusRequestEntityTooLarge
+		p.Title = "Upload too large"
+	}
+
+	sendProblem(w, p)
+}
+
+func sendProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func InspectHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	fullReader, ok := readJPEGBody(w, r)
+	if !ok {
+		return
+	}
+
+	mode, ok := jpegstrip.ParseModeFor(r.URL.Query().Get("mode"))
+	if !ok {
+		writeInvalidParameter(w, "mode", "mode must be one of default, strict or lenient")
+		return
+	}
+
+	report, err := jpegstrip.InspectMode(fullReader, mode, jpegstrip.DefaultLimits)
+	if err != nil {
+		writeProblem(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Answers with the anomalies that may hide a payload, for quarantining
+// suspect uploads
+func AnalyzeHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	fullReader, ok := readJPEGBody(w, r)
+	if !ok {
+		return
+	}
+
+	analysis, err := jpegstrip.Analyze(fullReader)
+	if err != nil {
+		writeProblem(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analysis)
+}
+
 func runHealthcheck(port string) {
 	url := "http://localhost:" + port + "/health"
 
@@ -103,6 +295,8 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /health", HealthHandler)
 	mux.HandleFunc("POST /strip", StripHandler)
+	mux.HandleFunc("POST /inspect", InspectHandler)
+	mux.HandleFunc("POST /analyze", AnalyzeHandler)
 
 	log.Printf("Server started on port: %s", port)
 	err := http.ListenAndServe(":"+port, mux)
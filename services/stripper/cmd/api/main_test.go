@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/daria/exif-cleaner/services/stripper/internal/jpegstrip"
 	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
 )
 
@@ -50,6 +52,401 @@ func TestStripHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("POST with EXIF and XMP removes both APP1 segments", func(t *testing.T) {
+		exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00something"))
+		xmp := testutil.MakeSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+		sos := testutil.MakeSOS([]byte{0x11, 0x22, 0x33})
+		jpeg := testutil.MakeJPEG(exif, xmp, sos)
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=exif&metadataType=xmp", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if testutil.ContainsMarker(rec.Body.Bytes(), 0xE1) {
+			t.Fatalf("expected both APP1 segments to be removed")
+		}
+	})
+
+	t.Run("POST with orientation=keep keeps the Orientation tag", func(t *testing.T) {
+		exif := testutil.Exif{IFD0: []testutil.Tag{
+			testutil.ASCII(0x010F, "ACME"),
+			testutil.Short(0x0112, 6),
+		}}
+		jpeg := testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=exif&orientation=keep", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		body := rec.Body.Bytes()
+		if bytes.Contains(body, []byte("ACME")) {
+			t.Fatalf("expected EXIF to be removed")
+		}
+		if !bytes.Contains(body, []byte{0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06}) {
+			t.Fatalf("expected Orientation tag to be kept")
+		}
+	})
+
+	t.Run("POST with trailer removes bytes after EOI", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+		withZip := append(append([]byte{}, jpeg...), "PK\x03\x04hidden"...)
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=trailer", bytes.NewReader(withZip))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), jpeg) {
+			t.Fatalf("expected trailing bytes to be removed")
+		}
+	})
+
+	t.Run("POST with gps:coarsen keeps a rounded position", func(t *testing.T) {
+		exif := testutil.Exif{GPS: []testutil.Tag{
+			testutil.ASCII(0x0001, "N"),
+			testutil.Rational(0x0002, 52, 1, 31, 1, 1234, 100),
+			testutil.ASCII(0x0003, "E"),
+			testutil.Rational(0x0004, 13, 1, 24, 1, 5678, 100),
+			testutil.Rational(0x0006, 345, 10),
+		}}
+		jpeg := testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=gps:coarsen=10", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		report, err := jpegstrip.Inspect(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		gps := report.Highlights.GPS
+		if gps == nil || gps.Altitude != nil || gps.Latitude == 52+31.0/60+12.34/3600 {
+			t.Fatalf("expected a rounded position without altitude, got %+v", gps)
+		}
+	})
+
+	t.Run("POST with time:shift moves the capture date", func(t *testing.T) {
+		exif := testutil.Exif{Exif: []testutil.Tag{testutil.ASCII(0x9003, "2024:05:01 23:30:00")}}
+		jpeg := testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=time:shift=-2d&metadataType=time:truncate=day", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		report, err := jpegstrip.Inspect(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		if got := report.Highlights.DateTimeOriginal; got != "2024:04:29 00:00:00" {
+			t.Fatalf("DateTimeOriginal = %q", got)
+		}
+	})
+
+	t.Run("POST with raw marker rules removes vendor segments", func(t *testing.T) {
+		ducky := testutil.MakeSegment(0xEC, []byte("Ducky\x00\x01"))
+		vendor := testutil.MakeSegment(0xE1, []byte("Vendor\x00data"))
+		exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00MM"))
+		sos := testutil.MakeSOS([]byte{0x11, 0x22, 0x33})
+		jpeg := testutil.MakeJPEG(ducky, vendor, exif, sos)
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=app12&metadataType=app1:prefix=56656e646f72", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if want := testutil.MakeJPEG(exif, sos); !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Fatalf("got %X, want %X", rec.Body.Bytes(), want)
+		}
+	})
+
+	t.Run("POST with all and keep=icc keeps only the ICC profile", func(t *testing.T) {
+		exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00something"))
+		icc := testutil.MakeSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+		app5 := testutil.MakeSegment(0xE5, []byte("vendor"))
+		sos := testutil.MakeSOS([]byte{0x11, 0x22, 0x33})
+		jpeg := testutil.MakeJPEG(exif, icc, app5, sos)
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=all&keep=icc", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if want := testutil.MakeJPEG(icc, sos); !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Fatalf("expected only the ICC profile to be kept")
+		}
+	})
+
+	t.Run("POST with unknown metadata types returns 422 with the list", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=EXIF&metadataType=exfi&metadataType=app16", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("expected application/problem+json, got %q", ct)
+		}
+		var body struct {
+			Status      int      `json:"status"`
+			Title       string   `json:"title"`
+			Unsupported []string `json:"unsupported"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if body.Status != http.StatusUnprocessableEntity || body.Title == "" {
+			t.Fatalf("unexpected problem %+v", body)
+		}
+		if len(body.Unsupported) != 2 || body.Unsupported[0] != "exfi" || body.Unsupported[1] != "app16" {
+			t.Fatalf("unsupported = %v", body.Unsupported)
+		}
+	})
+
+	t.Run("POST truncated JPEG returns problem details", func(t *testing.T) {
+		exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00MM\x00\x2A"))
+		jpeg := testutil.MakeJPEG(exif, testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=exif", bytes.NewReader(jpeg[:8]))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("expected application/problem+json, got %q", ct)
+		}
+		var p struct {
+			Status int    `json:"status"`
+			Reason string `json:"reason"`
+			Offset *int64 `json:"offset"`
+			Marker string `json:"marker"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if p.Status != 400 || p.Reason != "eof_in_segment" || p.Offset == nil || *p.Offset != 2 || p.Marker != "0xE1" {
+			t.Fatalf("unexpected problem %s", rec.Body.String())
+		}
+	})
+
+	t.Run("POST with a huge frame returns 422", func(t *testing.T) {
+		sof := testutil.MakeSegment(0xC0, []byte{8, 0xFF, 0xFF, 0xFF, 0xFF, 1, 1, 0x11, 0})
+		jpeg := testutil.MakeJPEG(sof, testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=exif", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d", rec.Code)
+		}
+		if !bytes.Contains(rec.Body.Bytes(), []byte(`"reason":"too_many_pixels"`)) {
+			t.Fatalf("unexpected problem %s", rec.Body.String())
+		}
+	})
+
+	t.Run("POST with mode=lenient recovers a truncated JPEG", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+		cut := jpeg[:len(jpeg)-2]
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?mode=lenient", bytes.NewReader(cut))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !bytes.Equal(rec.Body.Bytes(), jpeg) {
+			t.Fatalf("expected EOI to be added, got % X", rec.Body.Bytes())
+		}
+		var repairs []jpegstrip.Repair
+		if err := json.Unmarshal([]byte(rec.Header().Get("X-Repairs")), &repairs); err != nil {
+			t.Fatalf("invalid X-Repairs header: %v", err)
+		}
+		if len(repairs) != 2 || repairs[0].Kind != jpegstrip.RepairTruncatedScan || repairs[1].Kind != jpegstrip.RepairAddedEOI {
+			t.Fatalf("unexpected repairs %+v", repairs)
+		}
+	})
+
+	t.Run("POST with unknown mode returns 400", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?mode=sloppy", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest || !bytes.Contains(rec.Body.Bytes(), []byte(`"reason":"invalid_parameter","parameter":"mode"`)) {
+			t.Fatalf("expected invalid_parameter problem, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("POST with layout=canonical merges tables", func(t *testing.T) {
+		dqt := append([]byte{0x00}, make([]byte, 64)...)
+		jpeg := testutil.MakeJPEG(
+			testutil.MakeSegment(0xDB, dqt),
+			testutil.MakeSegment(0xFE, []byte("comment")),
+			testutil.MakeSegment(0xDB, append([]byte{0x01}, dqt[1:]...)),
+			testutil.MakeSOS([]byte{0x11, 0x22, 0x33}),
+		)
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?layout=canonical", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		want := testutil.MakeJPEG(
+			testutil.MakeSegment(0xFE, []byte("comment")),
+			testutil.MakeSegment(0xDB, append(append(dqt, 0x01), dqt[1:]...)),
+			testutil.MakeSOS([]byte{0x11, 0x22, 0x33}),
+		)
+		if !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Fatalf("unexpected output % X", rec.Body.Bytes())
+		}
+	})
+
+	t.Run("POST with unknown layout returns 400", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?layout=tidy", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest || !bytes.Contains(rec.Body.Bytes(), []byte(`"reason":"invalid_parameter","parameter":"layout"`)) {
+			t.Fatalf("expected invalid_parameter problem, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("POST with unknown keep returns 400", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?metadataType=all&keep=exif", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest || !bytes.Contains(rec.Body.Bytes(), []byte(`"reason":"invalid_parameter","parameter":"keep"`)) {
+			t.Fatalf("expected invalid_parameter problem, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("POST with unknown orientation returns 400", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/strip?orientation=sideways", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest || !bytes.Contains(rec.Body.Bytes(), []byte(`"reason":"invalid_parameter","parameter":"orientation"`)) {
+			t.Fatalf("expected invalid_parameter problem, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("POST over the upload limit returns 413", func(t *testing.T) {
+		body := append(testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11})), make([]byte, 10<<20)...)
+
+		req := httptest.NewRequest(http.MethodPost, "/strip", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /strip", StripHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusRequestEntityTooLarge || !bytes.Contains(rec.Body.Bytes(), []byte(`"reason":"read_failed"`)) {
+			t.Fatalf("expected 413 problem, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("expected application/problem+json, got %q", ct)
+		}
+	})
+
 	t.Run("GET /strip returns 405", func(t *testing.T) {
 		app1 := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00something"))
 		com := testutil.MakeSegment(0xFE, []byte("comment"))
@@ -93,3 +490,111 @@ func TestStripHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestInspectHandler(t *testing.T) {
+	t.Run("POST valid JPEG returns a JSON report", func(t *testing.T) {
+		exif := testutil.Exif{IFD0: []testutil.Tag{
+			testutil.ASCII(0x010F, "ACME"),
+			testutil.ASCII(0x0110, "Snap 3000"),
+		}}
+		com := testutil.MakeSegment(0xFE, []byte("comment"))
+		jpeg := testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), com, testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+
+		req := httptest.NewRequest(http.MethodPost, "/inspect", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /inspect", InspectHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Fatalf("Content-Type = %q", got)
+		}
+
+		var report jpegstrip.Report
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if report.Highlights.Make != "ACME" || report.Highlights.Model != "Snap 3000" {
+			t.Fatalf("unexpected highlights %+v", report.Highlights)
+		}
+		if len(report.Segments) != 5 || report.Segments[1].Type != jpegstrip.KindEXIF || report.Segments[2].Type != jpegstrip.KindComment {
+			t.Fatalf("unexpected segments %+v", report.Segments)
+		}
+	})
+
+	t.Run("POST with mode=strict rejects stray bytes", func(t *testing.T) {
+		sof := testutil.MakeSegment(0xC0, []byte{8, 0, 1, 0, 1, 1, 1, 0x11, 0})
+		jpeg := testutil.MakeJPEG(sof, append([]byte{0x00}, testutil.MakeSOS([]byte{0x11, 0x22, 0x33})...))
+
+		req := httptest.NewRequest(http.MethodPost, "/inspect?mode=strict", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /inspect", InspectHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest || !bytes.Contains(rec.Body.Bytes(), []byte(`"reason":"stray_bytes"`)) {
+			t.Fatalf("expected stray_bytes problem, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("POST non-JPEG returns 415", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/inspect", bytes.NewReader([]byte("hello")))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /inspect", InspectHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("expected 415, got %d", rec.Code)
+		}
+	})
+}
+
+func TestAnalyzeHandler(t *testing.T) {
+	t.Run("POST JPEG with a ZIP after EOI reports a high severity", func(t *testing.T) {
+		jpeg := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0x22, 0x33}))
+		jpeg = append(jpeg, "PK\x03\x04payload"...)
+
+		req := httptest.NewRequest(http.MethodPost, "/analyze", bytes.NewReader(jpeg))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /analyze", AnalyzeHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		var analysis jpegstrip.Analysis
+		if err := json.Unmarshal(rec.Body.Bytes(), &analysis); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if analysis.Severity != jpegstrip.SeverityHigh || len(analysis.Anomalies) != 1 || analysis.Anomalies[0].Kind != jpegstrip.AnomalyTrailer {
+			t.Fatalf("unexpected analysis %s", rec.Body.String())
+		}
+	})
+
+	t.Run("POST non-JPEG returns 415", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/analyze", bytes.NewReader([]byte("hello")))
+		rec := httptest.NewRecorder()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /analyze", AnalyzeHandler)
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("expected 415, got %d", rec.Code)
+		}
+	})
+}
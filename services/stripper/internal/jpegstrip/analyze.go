@@ -0,0 +1,298 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Severity says how likely an anomaly is to hide a payload
+type Severity string
+
+const (
+	SeverityLow    Severity = "low"    // unusual, but written by real software
+	SeverityMedium Severity = "medium" // room for data nothing reads
+	SeverityHigh   Severity = "high"   // data with no reason to be there
+)
+
+var severityRank = map[Severity]int{SeverityLow: 1, SeverityMedium: 2, SeverityHigh: 3}
+
+// AtLeast reports whether s is as severe as other or more
+func (s Severity) AtLeast(other Severity) bool {
+	return severityRank[s] >= severityRank[other]
+}
+
+// AnomalyKind names what Analyze found
+type AnomalyKind string
+
+const (
+	AnomalyLargeComment   AnomalyKind = "large_comment"
+	AnomalyLargeAPP       AnomalyKind = "large_app"      // a big APPn segment of unknown kind
+	AnomalyUnknownAPP     AnomalyKind = "unknown_app"    // an APPn segment of unknown kind
+	AnomalyUnknownMarker  AnomalyKind = "unknown_marker" // a reserved marker with a payload
+	AnomalyHighEntropy    AnomalyKind = "high_entropy"   // compressed or encrypted bytes in metadata
+	AnomalyTrailer        AnomalyKind = "trailer"        // data after EOI
+	AnomalyJFIFSize       AnomalyKind = "jfif_size"      // APP0 JFIF longer or shorter than its thumbnail
+	AnomalyEXIFDimensions AnomalyKind = "exif_dimensions"
+	AnomalyStrayBytes     AnomalyKind = "stray_bytes" // bytes between segments
+	AnomalyDamagedEnd     AnomalyKind = "damaged_end" // the file ends early and was read as far as it goes
+)
+
+// Anomaly is one finding, at an input offset
+type Anomaly struct {
+	Kind     AnomalyKind `json:"kind"`
+	Severity Severity    `json:"severity"`
+	Offset   int64       `json:"offset"`
+	Length   int64       `json:"length,omitempty"`
+	Marker   byte        `json:"marker,omitempty"`
+	Detail   string      `json:"detail"`
+}
+
+// Analysis lists the anomalies of a file, in file order
+type Analysis struct {
+	Severity  Severity  `json:"severity,omitempty"` // the highest found, empty for none
+	Anomalies []Anomaly `json:"anomalies"`
+}
+
+// Thresholds above which a segment is worth a look
+const (
+	maxCommentSize = 1 << 10
+	maxUnknownAPP  = 4 << 10
+	minEntropySize = 256
+	maxEntropy     = 7.5 // bits per byte, compressed data comes close to 8
+)
+
+// Analyze walks a JPEG like Inspect and reports what may hide a payload:
+// oversized or unknown segments, high-entropy metadata, data after EOI and
+// headers that don't agree with the frame. Damaged files are read as far as
+// they go, which is an anomaly of its own.
+func Analyze(in io.Reader) (*Analysis, error) {
+	data, err := readLimited(in, DefaultLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Analysis{Anomalies: []Anomaly{}}
+	b := newBudget(DefaultLimits)
+
+	// Secondary MPF images are checked like the primary one, and only what
+	// comes after the last of them is a trailer
+	images := []mpImage{{size: len(data)}}
+	if mp, ok := parseMPF(data, b); ok {
+		images[0].size = mp.end
+		images = append(images, mp.images...)
+	}
+
+	end := 0
+	for _, img := range images {
+		if img.start > end {
+			a.addRepairs([]Repair{{Offset: int64(end), Kind: RepairSkippedBytes, Length: int64(img.start - end)}})
+		}
+		n, err := a.checkImage(data[img.start:img.start+img.size], int64(img.start), b)
+		if err != nil {
+			return nil, shiftError(err, int64(img.start))
+		}
+		end = img.start + n
+	}
+	a.addTrailer(data[end:], int64(end))
+
+	sort.SliceStable(a.Anomalies, func(i, j int) bool { return a.Anomalies[i].Offset < a.Anomalies[j].Offset })
+	return a, nil
+}
+
+// Checks the segments of one image, found at base in the file, and returns
+// where its EOI ends
+func (a *Analysis) checkImage(data []byte, base int64, b *budget) (int, error) {
+	sr := newSegmentReader(bytes.NewReader(data))
+	sr.mode, sr.budget = ParseLenient, b
+	if err := sr.readSOI(); err != nil {
+		return 0, err
+	}
+
+	found := &Analysis{}
+	var width, height int
+	var exifDims []uint32
+	var exifOffset int64
+
+	for {
+		seg, err := sr.next()
+		if err != nil {
+			return 0, err
+		}
+
+		switch seg.marker {
+		case 0xD9:
+			if exifDims != nil && width > 0 && !sameSize(exifDims, width, height) {
+				found.add(Anomaly{Kind: AnomalyEXIFDimensions, Severity: SeverityMedium, Offset: exifOffset, Marker: 0xE1,
+					Detail: fmt.Sprintf("EXIF says %dx%d, the frame is %dx%d", exifDims[0], exifDims[1], width, height)})
+			}
+			found.addRepairs(sr.repairs)
+
+			for _, an := range found.Anomalies {
+				an.Offset += base
+				a.add(an)
+			}
+			return int(sr.off), nil
+		case 0xDA:
+			if err := sr.copyEntropy(io.Discard); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if seg.payload == nil {
+			continue
+		}
+		if isFrameMarker(seg.marker) && len(seg.payload) >= 5 {
+			height = int(binary.BigEndian.Uint16(seg.payload[1:]))
+			width = int(binary.BigEndian.Uint16(seg.payload[3:]))
+		}
+		kind := classify(seg.marker, seg.payload)
+		if kind == KindEXIF && exifDims == nil {
+			exifDims, exifOffset = exifDimensions(seg.payload), seg.offset
+		}
+		found.checkSegment(seg, kind)
+	}
+}
+
+func (a *Analysis) add(an Anomaly) {
+	a.Anomalies = append(a.Anomalies, an)
+	if an.Severity.AtLeast(a.Severity) {
+		a.Severity = an.Severity
+	}
+}
+
+// Checks a segment with a payload on its own
+func (a *Analysis) checkSegment(seg segment, kind Kind) {
+	size := int64(len(seg.payload))
+	at := Anomaly{Offset: seg.offset, Length: int64(seg.size()), Marker: seg.marker}
+	isAPP := seg.marker >= 0xE0 && seg.marker <= 0xEF
+
+	switch {
+	case kind == KindComment && size > maxCommentSize:
+		at.Kind, at.Severity = AnomalyLargeComment, SeverityMedium
+		at.Detail = fmt.Sprintf("comment of %d bytes", size)
+		a.add(at)
+	case kind == KindUnknown && isAPP && size > maxUnknownAPP:
+		at.Kind, at.Severity = AnomalyLargeAPP, SeverityMedium
+		at.Detail = fmt.Sprintf("%s segment of unknown kind with %d bytes", markerName(seg.marker), size)
+		a.add(at)
+	case kind == KindUnknown && isAPP:
+		at.Kind, at.Severity = AnomalyUnknownAPP, SeverityLow
+		at.Detail = fmt.Sprintf("%s segment of unknown kind", markerName(seg.marker))
+		a.add(at)
+	case kind == KindUnknown:
+		at.Kind, at.Severity = AnomalyUnknownMarker, SeverityHigh
+		at.Detail = fmt.Sprintf("reserved marker %s", markerName(seg.marker))
+		a.add(at)
+	case kind == KindJFIF && len(seg.payload) >= jfifHeaderSize:
+		want := jfifHeaderSize + 3*int(seg.payload[12])*int(seg.payload[13])
+		if len(seg.payload) != want {
+			at.Kind, at.Severity = AnomalyJFIFSize, SeverityHigh
+			at.Detail = fmt.Sprintf("JFIF segment of %d bytes for a %dx%d thumbnail of %d", len(seg.payload), seg.payload[12], seg.payload[13], want)
+			a.add(at)
+		}
+	}
+
+	// EXIF, Photoshop resources and JUMBF boxes carry JPEG thumbnails, and
+	// FPXR, MPF and ICC profiles are binary, so only the rest should read
+	// like text or tables
+	switch kind {
+	case KindEXIF, KindIPTC, KindJUMBF, KindFPXR, KindMPF, KindICC, KindImage:
+		return
+	}
+	if size >= minEntropySize {
+		if h := entropy(seg.payload); h > maxEntropy {
+			at.Kind, at.Severity = AnomalyHighEntropy, SeverityHigh
+			at.Detail = fmt.Sprintf("%s payload with %.2f bits of entropy per byte", markerName(seg.marker), h)
+			a.add(at)
+		}
+	}
+}
+
+// Turns what lenient parsing repaired into anomalies
+func (a *Analysis) addRepairs(repairs []Repair) {
+	for _, r := range repairs {
+		at := Anomaly{Offset: r.Offset, Length: r.Length}
+		switch r.Kind {
+		case RepairSkippedBytes:
+			at.Kind, at.Severity = AnomalyStrayBytes, SeverityMedium
+			at.Detail = fmt.Sprintf("%d bytes between segments", r.Length)
+		case RepairTruncatedScan, RepairDroppedSegment:
+			at.Kind, at.Severity = AnomalyDamagedEnd, SeverityLow
+			at.Detail = "file ends early: " + string(r.Kind)
+		default:
+			continue
+		}
+		a.add(at)
+	}
+}
+
+// Rates the data after EOI by what it looks like. Videos and vendor
+// trailers are common, archives and unknown data are not.
+func (a *Analysis) addTrailer(data []byte, offset int64) {
+	if len(data) == 0 {
+		return
+	}
+
+	kind := classifyTrailer(data)
+	at := Anomaly{Kind: AnomalyTrailer, Offset: offset, Length: int64(len(data))}
+	switch kind {
+	case TrailerPadding:
+		return
+	case TrailerJPEG:
+		at.Severity = SeverityMedium
+	case TrailerMP4, TrailerSamsung:
+		at.Severity = SeverityLow
+	default:
+		at.Severity = SeverityHigh
+	}
+	at.Detail = fmt.Sprintf("%d bytes of %s data after EOI", len(data), kind)
+	a.add(at)
+}
+
+// Returns PixelXDimension and PixelYDimension of an APP1 EXIF payload, or nil
+func exifDimensions(payload []byte) []uint32 {
+	t, err := parseTIFF(payload[len(exifPrefix):])
+	if err != nil {
+		return nil
+	}
+	ifd := t.ifd(ExifIFD)
+	x, y := ifd.find(tagPixelXDimension), ifd.find(tagPixelYDimension)
+	if x == nil || y == nil {
+		return nil
+	}
+	xs, ys := x.uints(t.order), y.uints(t.order)
+	if len(xs) != 1 || len(ys) != 1 {
+		return nil
+	}
+	return []uint32{xs[0], ys[0]}
+}
+
+// Reports whether EXIF dimensions match the frame, either way round as some
+// cameras give them for the rotated picture
+func sameSize(dims []uint32, width, height int) bool {
+	w, h := uint32(width), uint32(height)
+	return dims[0] == w && dims[1] == h || dims[0] == h && dims[1] == w
+}
+
+// Returns the Shannon entropy of data in bits per byte
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	var h float64
+	n := float64(len(data))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
@@ -0,0 +1,195 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestAnalyze(t *testing.T) {
+	sof := testutil.MakeSegment(0xC0, []byte{8, 0, 16, 0, 32, 1, 1, 0x11, 0})
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+
+	analyze := func(t *testing.T, img []byte) *Analysis {
+		t.Helper()
+		a, err := Analyze(bytes.NewReader(img))
+		if err != nil {
+			t.Fatalf("Analyze: %v", err)
+		}
+		return a
+	}
+	// Returns the only anomaly of the given kind
+	find := func(t *testing.T, a *Analysis, kind AnomalyKind) Anomaly {
+		t.Helper()
+		var found []Anomaly
+		for _, an := range a.Anomalies {
+			if an.Kind == kind {
+				found = append(found, an)
+			}
+		}
+		if len(found) != 1 {
+			t.Fatalf("expected one %s anomaly, got %+v", kind, a.Anomalies)
+		}
+		return found[0]
+	}
+
+	random := make([]byte, 2048)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	t.Run("Clean camera file", func(t *testing.T) {
+		exif := testutil.Exif{
+			IFD0:      []testutil.Tag{testutil.ASCII(0x010F, "ACME")},
+			Exif:      []testutil.Tag{testutil.Long(0xA002, 32), testutil.Long(0xA003, 16)},
+			Thumbnail: makePicture(t, 64, 48, image.Rect(0, 0, 64, 48), false),
+		}
+		img := testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), sof, sos)
+
+		a := analyze(t, img)
+		if a.Severity != "" || len(a.Anomalies) != 0 {
+			t.Fatalf("unexpected anomalies %+v", a.Anomalies)
+		}
+	})
+
+	t.Run("Large comment", func(t *testing.T) {
+		com := testutil.MakeSegment(0xFE, []byte(strings.Repeat("a", 2000)))
+		a := analyze(t, testutil.MakeJPEG(com, sof, sos))
+
+		if an := find(t, a, AnomalyLargeComment); an.Severity != SeverityMedium || an.Offset != 2 || an.Marker != 0xFE {
+			t.Fatalf("unexpected %+v", an)
+		}
+		if a.Severity != SeverityMedium {
+			t.Fatalf("severity is %q", a.Severity)
+		}
+	})
+
+	t.Run("Unknown APP segments", func(t *testing.T) {
+		small := testutil.MakeSegment(0xE9, []byte("vendor"))
+		large := testutil.MakeSegment(0xEA, []byte(strings.Repeat("b", 5000)))
+		a := analyze(t, testutil.MakeJPEG(small, large, sof, sos))
+
+		if an := find(t, a, AnomalyUnknownAPP); an.Severity != SeverityLow || an.Marker != 0xE9 {
+			t.Fatalf("unexpected %+v", an)
+		}
+		if an := find(t, a, AnomalyLargeAPP); an.Severity != SeverityMedium || an.Marker != 0xEA {
+			t.Fatalf("unexpected %+v", an)
+		}
+	})
+
+	t.Run("Reserved marker", func(t *testing.T) {
+		a := analyze(t, testutil.MakeJPEG(testutil.MakeSegment(0xF3, []byte("hidden")), sof, sos))
+		if an := find(t, a, AnomalyUnknownMarker); an.Severity != SeverityHigh || an.Marker != 0xF3 {
+			t.Fatalf("unexpected %+v", an)
+		}
+	})
+
+	t.Run("High entropy in XMP", func(t *testing.T) {
+		xmp := testutil.MakeSegment(0xE1, append(append([]byte{}, xmpPrefix...), random...))
+		a := analyze(t, testutil.MakeJPEG(xmp, sof, sos))
+		if an := find(t, a, AnomalyHighEntropy); an.Severity != SeverityHigh || an.Marker != 0xE1 {
+			t.Fatalf("unexpected %+v", an)
+		}
+
+		// EXIF carries a compressed thumbnail, so it is left alone
+		exif := testutil.Exif{IFD0: []testutil.Tag{testutil.Undefined(0x927C, random)}}
+		if a := analyze(t, testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), sof, sos)); len(a.Anomalies) != 0 {
+			t.Fatalf("unexpected anomalies %+v", a.Anomalies)
+		}
+	})
+
+	t.Run("ICC profiles are left alone", func(t *testing.T) {
+		icc := testutil.MakeSegment(0xE2, append(append([]byte{}, iccPrefix...), append([]byte{1, 1}, random...)...))
+		if a := analyze(t, testutil.MakeJPEG(icc, sof, sos)); len(a.Anomalies) != 0 {
+			t.Fatalf("unexpected anomalies %+v", a.Anomalies)
+		}
+	})
+
+	t.Run("Secondary MPF images are checked", func(t *testing.T) {
+		com := testutil.MakeSegment(0xFE, []byte(strings.Repeat("a", 2000)))
+		depth := testutil.MakeJPEG(sof, sos)
+		gain := testutil.MakeJPEG(com, sof, sos)
+		img := makeMPFImage([][]byte{sof}, depth, gain)
+
+		a := analyze(t, img)
+		if an := find(t, a, AnomalyLargeComment); an.Offset != int64(len(img)-len(gain)+2) {
+			t.Fatalf("unexpected %+v", an)
+		}
+		if len(a.Anomalies) != 1 {
+			t.Fatalf("unexpected anomalies %+v", a.Anomalies)
+		}
+
+		withZip := append(append([]byte{}, img...), "PK\x03\x04"...)
+		if an := find(t, analyze(t, withZip), AnomalyTrailer); an.Offset != int64(len(img)) || an.Severity != SeverityHigh {
+			t.Fatalf("unexpected %+v", an)
+		}
+	})
+
+	t.Run("Data after EOI", func(t *testing.T) {
+		base := testutil.MakeJPEG(sof, sos)
+		for trailer, want := range map[string]Severity{
+			"PK\x03\x04archive":        SeverityHigh,
+			"something else":           SeverityHigh,
+			"\x00\x00\x00\x18ftypmp42": SeverityLow,
+			"\xFF\xD8\xFF\xD9":         SeverityMedium,
+		} {
+			a := analyze(t, append(append([]byte{}, base...), trailer...))
+			an := find(t, a, AnomalyTrailer)
+			if an.Severity != want || an.Offset != int64(len(base)) || an.Length != int64(len(trailer)) {
+				t.Fatalf("%q: unexpected %+v", trailer, an)
+			}
+		}
+
+		if a := analyze(t, append(append([]byte{}, base...), 0, 0, 0)); len(a.Anomalies) != 0 {
+			t.Fatalf("padding: unexpected anomalies %+v", a.Anomalies)
+		}
+	})
+
+	t.Run("JFIF longer than its thumbnail", func(t *testing.T) {
+		jfif := append([]byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x01\x01"), 1, 2, 3, 'x', 'y')
+		a := analyze(t, testutil.MakeJPEG(testutil.MakeSegment(0xE0, jfif), sof, sos))
+		if an := find(t, a, AnomalyJFIFSize); an.Severity != SeverityHigh || an.Offset != 2 {
+			t.Fatalf("unexpected %+v", an)
+		}
+	})
+
+	t.Run("EXIF dimensions that don't match the frame", func(t *testing.T) {
+		exif := testutil.Exif{Exif: []testutil.Tag{testutil.Long(0xA002, 4000), testutil.Long(0xA003, 3000)}}
+		a := analyze(t, testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), sof, sos))
+		if an := find(t, a, AnomalyEXIFDimensions); an.Severity != SeverityMedium || an.Offset != 2 {
+			t.Fatalf("unexpected %+v", an)
+		}
+
+		// Swapped for the rotated picture is fine
+		exif = testutil.Exif{Exif: []testutil.Tag{testutil.Short(0xA002, 16), testutil.Short(0xA003, 32)}}
+		if a := analyze(t, testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), sof, sos)); len(a.Anomalies) != 0 {
+			t.Fatalf("unexpected anomalies %+v", a.Anomalies)
+		}
+	})
+
+	t.Run("Stray bytes and a damaged end", func(t *testing.T) {
+		img := testutil.MakeJPEG(sof, append([]byte("xyz"), sos...))
+		img = img[:len(img)-2]
+		a := analyze(t, img)
+
+		if an := find(t, a, AnomalyStrayBytes); an.Severity != SeverityMedium || an.Length != 3 {
+			t.Fatalf("unexpected %+v", an)
+		}
+		if an := find(t, a, AnomalyDamagedEnd); an.Severity != SeverityLow {
+			t.Fatalf("unexpected %+v", an)
+		}
+		for i := 1; i < len(a.Anomalies); i++ {
+			if a.Anomalies[i].Offset < a.Anomalies[i-1].Offset {
+				t.Fatalf("anomalies out of order %+v", a.Anomalies)
+			}
+		}
+	})
+
+	t.Run("Severity order", func(t *testing.T) {
+		if !SeverityHigh.AtLeast(SeverityMedium) || SeverityLow.AtLeast(SeverityMedium) || !SeverityLow.AtLeast("") {
+			t.Fatalf("unexpected order")
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// LayoutMode decides how the segments of the output are laid out
+type LayoutMode int
+
+const (
+	// LayoutKeep writes the segments that are kept in their original order
+	LayoutKeep LayoutMode = iota
+	// LayoutCanonical rebuilds the structure the way one encoder would write
+	// it, so padding and ordering don't give away the source software. The
+	// APPn segments come first by number, then comments, and in front of
+	// every scan a single DQT, the frame header, a single DHT and DRI. The
+	// entropy-coded data is copied unchanged, so the pixels are too.
+	LayoutCanonical
+)
+
+// The segments in front of one scan, and the scan itself
+type scanGroup struct {
+	other   []segment       // kept in place, such as DNL after a scan
+	dqt     map[byte][]byte // quantization tables by id
+	dht     map[byte][]byte // Huffman tables by id<<4 | class
+	dri     []byte
+	frame   *segment
+	sos     *segment
+	entropy bytes.Buffer
+}
+
+func newScanGroup() *scanGroup {
+	return &scanGroup{dqt: make(map[byte][]byte), dht: make(map[byte][]byte)}
+}
+
+// Rewrites a clean image from the stripper in the canonical layout, and
+// copies whatever follows EOI as it is
+func rebuild(data []byte, out io.Writer) error {
+	sr := newSegmentReader(bytes.NewReader(data))
+	if err := sr.readSOI(); err != nil {
+		return err
+	}
+
+	var meta []segment
+	var groups []*scanGroup
+	g := newScanGroup()
+
+	for {
+		seg, err := sr.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case seg.marker == 0xD9:
+			if err := writeCanonical(out, meta, append(groups, g)); err != nil {
+				return err
+			}
+			_, err = io.Copy(out, sr)
+			return writeFailed(segment{offset: -1}, err)
+		case seg.marker >= 0xE0 && seg.marker <= 0xEF, seg.marker == 0xFE:
+			meta = append(meta, seg)
+		case seg.marker == 0xDB:
+			if !splitTables(seg.payload, g.dqt, dqtTable) {
+				return &Error{Offset: -1, Marker: seg.marker, Reason: ReasonBadTable}
+			}
+		case seg.marker == 0xC4:
+			if !splitTables(seg.payload, g.dht, dhtTable) {
+				return &Error{Offset: -1, Marker: seg.marker, Reason: ReasonBadTable}
+			}
+		case seg.marker == 0xDD:
+			g.dri = seg.payload
+		case isFrameMarker(seg.marker) && g.frame == nil:
+			g.frame = &seg
+		case seg.marker == 0xDA:
+			g.sos = &seg
+			if err := sr.copyEntropy(&g.entropy); err != nil {
+				return err
+			}
+			groups = append(groups, g)
+			g = newScanGroup()
+		case seg.payload == nil:
+			// RST and TEM outside of a scan mean nothing
+		default:
+			g.other = append(g.other, seg)
+		}
+	}
+}
+
+// Writes SOI, the metadata segments and every scan group, ending in EOI
+func writeCanonical(out io.Writer, meta []segment, groups []*scanGroup) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8})
+
+	// COM sorts after APP15, the order of segments with the same marker stays
+	sort.SliceStable(meta, func(i, j int) bool { return meta[i].marker < meta[j].marker })
+	for _, seg := range meta {
+		if err := seg.writeTo(&buf); err != nil {
+			return err
+		}
+	}
+
+	for _, g := range groups {
+		if err := g.writeTo(&buf); err != nil {
+			return err
+		}
+	}
+	buf.Write([]byte{0xFF, 0xD9})
+
+	_, err := out.Write(buf.Bytes())
+	return writeFailed(segment{offset: -1}, err)
+}
+
+func (g *scanGroup) writeTo(out io.Writer) error {
+	for _, seg := range g.other {
+		if err := seg.writeTo(out); err != nil {
+			return err
+		}
+	}
+	if err := writeTables(out, 0xDB, g.dqt); err != nil {
+		return err
+	}
+	if g.frame != nil {
+		if err := g.frame.writeTo(out); err != nil {
+			return err
+		}
+	}
+	if err := writeTables(out, 0xC4, g.dht); err != nil {
+		return err
+	}
+	if g.dri != nil {
+		if err := writeSegment(out, 0xDD, g.dri); err != nil {
+			return err
+		}
+	}
+	if g.sos == nil {
+		return nil
+	}
+	if err := g.sos.writeTo(out); err != nil {
+		return err
+	}
+	_, err := out.Write(g.entropy.Bytes())
+	return err
+}
+
+// Writes the tables of a group as one segment, in the order of their keys
+func writeTables(out io.Writer, marker byte, tables map[byte][]byte) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	var payload []byte
+	for _, key := range slices.Sorted(maps.Keys(tables)) {
+		payload = append(payload, tables[key]...)
+	}
+	return writeSegment(out, marker, payload)
+}
+
+// Splits a DQT or DHT payload into its tables, a later table replacing an
+// earlier one with the same key. It reports false for a malformed payload.
+func splitTables(payload []byte, tables map[byte][]byte, table func([]byte) (byte, int, bool)) bool {
+	for len(payload) > 0 {
+		key, size, ok := table(payload)
+		if !ok || size > len(payload) {
+			return false
+		}
+		tables[key] = payload[:size]
+		payload = payload[size:]
+	}
+	return true
+}
+
+// Returns the id and size of the quantization table at the start of p
+func dqtTable(p []byte) (byte, int, bool) {
+	precision, id := p[0]>>4, p[0]&0x0F
+	if precision > 1 || id > 3 {
+		return 0, 0, false
+	}
+	return id, 1 + 64*int(precision+1), true
+}
+
+// Returns the key and size of the Huffman table at the start of p. The key
+// puts the DC and AC tables of one id next to each other.
+func dhtTable(p []byte) (byte, int, bool) {
+	class, id := p[0]>>4, p[0]&0x0F
+	if class > 1 || id > 3 || len(p) < 17 {
+		return 0, 0, false
+	}
+	size := 17
+	for _, n := range p[1:17] {
+		size += int(n)
+	}
+	return id<<4 | class, size, true
+}
@@ -0,0 +1,147 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestCanonicalLayout(t *testing.T) {
+	canonical := func(t *testing.T, img []byte) []byte {
+		t.Helper()
+		p := NewPolicy()
+		p.Layout = LayoutCanonical
+		return stripBytes(t, img, p)
+	}
+
+	// image/jpeg writes SOI, one DQT, SOF0, one DHT and the scan, in the
+	// canonical layout already
+	rgba := image.NewRGBA(image.Rect(0, 0, 48, 32))
+	for y := range 32 {
+		for x := range 48 {
+			rgba.Set(x, y, color.RGBA{uint8(5 * x), uint8(7 * y), uint8(x * y), 255})
+		}
+	}
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, rgba, &jpeg.Options{Quality: 80}); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	orig := enc.Bytes()
+
+	header := headerSegments(orig)
+	scan := 2
+	for _, s := range header {
+		scan += 4 + len(s.payload)
+	}
+	var dqt, sof, dht []byte
+	for _, s := range header {
+		switch s.marker {
+		case 0xDB:
+			dqt = s.payload
+		case 0xC0:
+			sof = s.payload
+		case 0xC4:
+			dht = s.payload
+		}
+	}
+
+	xmp := testutil.MakeSegment(0xE1, append(append([]byte{}, xmpPrefix...), "<x/>"...))
+	com := testutil.MakeSegment(0xFE, []byte("made by"))
+	jfif := testutil.MakeSegment(0xE0, []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"))
+
+	t.Run("Split tables, odd order and fill bytes", func(t *testing.T) {
+		var b bytes.Buffer
+		b.Write(orig[:2])
+		b.Write(testutil.MakeSegment(0xDB, dqt[:65]))
+		b.Write(xmp)
+		tables := dht
+		for len(tables) > 0 {
+			_, n, _ := dhtTable(tables)
+			b.Write(testutil.MakeSegment(0xC4, tables[:n]))
+			tables = tables[n:]
+		}
+		b.Write([]byte{0xFF, 0xFF, 0xFF})
+		b.Write(testutil.MakeSegment(0xC0, sof))
+		b.Write(com)
+		b.Write(testutil.MakeSegment(0xDB, dqt[65:]))
+		b.Write(jfif)
+		b.Write([]byte{0xFF, 0xD0}) // a restart marker outside of the scan
+		b.Write(orig[scan:])
+
+		got := canonical(t, b.Bytes())
+
+		want := append(append(append(append([]byte{}, orig[:2]...), jfif...), xmp...), com...)
+		want = append(want, orig[2:]...)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("unexpected layout\n got % X\nwant % X", got[:120], want[:120])
+		}
+
+		a, _ := jpeg.Decode(bytes.NewReader(orig))
+		c, err := jpeg.Decode(bytes.NewReader(got))
+		if err != nil || !bytes.Equal(a.(*image.YCbCr).Y, c.(*image.YCbCr).Y) || !bytes.Equal(a.(*image.YCbCr).Cr, c.(*image.YCbCr).Cr) {
+			t.Fatalf("pixels differ: %v", err)
+		}
+	})
+
+	t.Run("A redefined table replaces the earlier one", func(t *testing.T) {
+		old := append([]byte{0x00}, make([]byte, 64)...)
+		img := append(append([]byte{}, orig[:2]...), testutil.MakeSegment(0xDB, old)...)
+		img = append(img, orig[2:]...)
+
+		if got := canonical(t, img); !bytes.Equal(got, orig) {
+			t.Fatalf("expected the later table to be kept")
+		}
+	})
+
+	t.Run("Tables between scans stay with their scan", func(t *testing.T) {
+		sof := testutil.MakeSegment(0xC2, []byte{8, 0, 8, 0, 8, 1, 1, 0x11, 0})
+		dc := testutil.MakeSegment(0xC4, append([]byte{0x00, 1}, append(make([]byte, 15), 0)...))
+		ac := testutil.MakeSegment(0xC4, append([]byte{0x10, 1}, append(make([]byte, 15), 0)...))
+		app := testutil.MakeSegment(0xEC, []byte("late"))
+		scan1, scan2 := testutil.MakeSOS([]byte{0x11}), testutil.MakeSOS([]byte{0x22})
+
+		img := testutil.MakeJPEG(sof, dc, scan1, app, ac, scan2)
+		want := testutil.MakeJPEG(app, sof, dc, scan1, ac, scan2)
+		if got := canonical(t, img); !bytes.Equal(got, want) {
+			t.Fatalf("unexpected layout\n got % X\nwant % X", got, want)
+		}
+	})
+
+	t.Run("Trailer is kept", func(t *testing.T) {
+		img := append(append([]byte{}, orig...), "trailer"...)
+		if got := canonical(t, img); !bytes.Equal(got, img) {
+			t.Fatalf("expected the trailer to be kept")
+		}
+	})
+
+	t.Run("MPF index points at the rebuilt images", func(t *testing.T) {
+		com := testutil.MakeSegment(0xFE, []byte("moves behind the MPF index"))
+		gain := testutil.MakeJPEG(com, xmp, testutil.MakeSOS([]byte{0x44}))
+		got := canonical(t, makeMPFImage([][]byte{com}, gain))
+
+		if !bytes.Contains(got, append(append([]byte{}, testutil.MakeSOS([]byte{0x11, 0x22})...), 0xFF, 0xD9)) {
+			t.Fatalf("primary scan lost")
+		}
+		images := mpfImages(t, got)
+		if want := testutil.MakeJPEG(xmp, com, testutil.MakeSOS([]byte{0x44})); len(images) != 1 || !bytes.Equal(images[0], want) {
+			t.Fatalf("unexpected secondary images % X", images)
+		}
+	})
+
+	t.Run("Malformed table", func(t *testing.T) {
+		img := testutil.MakeJPEG(testutil.MakeSegment(0xC4, []byte{0x25, 1, 2}), testutil.MakeSOS([]byte{0x11}))
+		p := NewPolicy()
+		p.Layout = LayoutCanonical
+
+		err := Strip(bytes.NewReader(img), &bytes.Buffer{}, p)
+		var e *Error
+		if !errors.Is(err, ErrTruncated) || !errors.As(err, &e) || e.Reason != ReasonBadTable || e.Marker != 0xC4 {
+			t.Fatalf("expected a bad table error, got %v", err)
+		}
+	})
+}
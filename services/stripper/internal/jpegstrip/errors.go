@@ -0,0 +1,130 @@
+package jpegstrip
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrTruncated = errors.New("truncated or malformed JPEG")
+var ErrNotJPEG = errors.New("not a JPEG (missing SOI)")
+var ErrSegmentTooLarge = errors.New("segment payload exceeds 65533 bytes")
+
+// Reason says what went wrong in a JPEG stream, as a stable code
+type Reason string
+
+const (
+	ReasonNotJPEG      Reason = "not_jpeg"          // no SOI at the start
+	ReasonBadLength    Reason = "bad_length"        // segment length field below 2
+	ReasonEOFInSegment Reason = "eof_in_segment"    // input ends inside a segment
+	ReasonEOFInScan    Reason = "eof_in_scan"       // input ends inside entropy-coded data
+	ReasonMissingEOI   Reason = "missing_eoi"       // input ends between segments
+	ReasonTooLarge     Reason = "segment_too_large" // an edited payload no longer fits
+	ReasonStrayBytes   Reason = "stray_bytes"       // bytes between segments, in strict mode
+	ReasonNonCanonical Reason = "non_canonical"     // a marker out of place, in strict mode
+	ReasonBadTable     Reason = "bad_table"         // a DQT or DHT payload that doesn't parse
+	ReasonSizeLimit    Reason = "file_too_large"    // see Limits
+	ReasonSegmentLimit Reason = "too_many_segments"
+	ReasonAPPLimit     Reason = "too_much_app_data"
+	ReasonPixelLimit   Reason = "too_many_pixels"
+	ReasonScanLimit    Reason = "too_many_scans"
+	ReasonRead         Reason = "read_failed"
+	ReasonWrite        Reason = "write_failed"
+)
+
+var reasonText = map[Reason]string{
+	ReasonNotJPEG:      "not a JPEG (missing SOI)",
+	ReasonBadLength:    "segment length below 2",
+	ReasonEOFInSegment: "input ends inside a segment",
+	ReasonEOFInScan:    "input ends inside a scan",
+	ReasonMissingEOI:   "input ends before EOI",
+	ReasonTooLarge:     "segment payload exceeds 65533 bytes",
+	ReasonStrayBytes:   "stray bytes before a marker",
+	ReasonNonCanonical: "marker out of place",
+	ReasonBadTable:     "malformed table",
+	ReasonSizeLimit:    "file size limit exceeded",
+	ReasonSegmentLimit: "segment count limit exceeded",
+	ReasonAPPLimit:     "APP segment size limit exceeded",
+	ReasonPixelLimit:   "frame size limit exceeded",
+	ReasonScanLimit:    "scan count limit exceeded",
+	ReasonRead:         "read failed",
+	ReasonWrite:        "write failed",
+}
+
+// Error is a failure at a known place in a JPEG stream. It matches
+// ErrTruncated, ErrNotJPEG, ErrSegmentTooLarge and ErrLimitExceeded with
+// errors.Is. It unwraps to the reader or writer error behind it, if any.
+type Error struct {
+	Offset int64 // input position of the marker involved, -1 when unknown
+	Marker byte  // 0 when no segment is involved
+	Reason Reason
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := reasonText[e.Reason]
+	if msg == "" {
+		msg = string(e.Reason)
+	}
+	if e.Offset >= 0 {
+		msg += fmt.Sprintf(" at offset %d", e.Offset)
+	}
+	if e.Marker != 0 {
+		msg += fmt.Sprintf(" (%s)", markerName(e.Marker))
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrTruncated:
+		switch e.Reason {
+		case ReasonBadLength, ReasonEOFInSegment, ReasonEOFInScan, ReasonMissingEOI,
+			ReasonStrayBytes, ReasonNonCanonical, ReasonBadTable:
+			return true
+		}
+		return false
+	case ErrNotJPEG:
+		return e.Reason == ReasonNotJPEG
+	case ErrSegmentTooLarge:
+		return e.Reason == ReasonTooLarge
+	case ErrLimitExceeded:
+		switch e.Reason {
+		case ReasonSizeLimit, ReasonSegmentLimit, ReasonAPPLimit, ReasonPixelLimit, ReasonScanLimit:
+			return true
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// Attributes an output failure to the segment being written
+func writeFailed(seg segment, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Offset < 0 {
+			e.Offset = seg.offset
+		}
+		return e
+	}
+	return &Error{Offset: seg.offset, Marker: seg.marker, Reason: ReasonWrite, Err: err}
+}
+
+// Moves the offset of an error from an image embedded at base to the file
+func shiftError(err error, base int64) error {
+	var e *Error
+	if errors.As(err, &e) && e.Offset >= 0 {
+		e.Offset += base
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+type failingWriter struct{ after int }
+
+var errDiskFull = errors.New("disk full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.after {
+		n := w.after
+		w.after = 0
+		return n, errDiskFull
+	}
+	w.after -= len(p)
+	return len(p), nil
+}
+
+func TestError(t *testing.T) {
+	exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00MM"))
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+	valid := testutil.MakeJPEG(exif, sos)
+
+	strip := func(t *testing.T, img []byte) *Error {
+		t.Helper()
+		err := Strip(bytes.NewReader(img), &bytes.Buffer{}, NewPolicy())
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("expected *Error, got %T %v", err, err)
+		}
+		return e
+	}
+
+	cases := []struct {
+		name   string
+		img    []byte
+		want   Error
+		target error
+	}{
+		{"Missing SOI", []byte("GIF89a"), Error{Offset: 0, Reason: ReasonNotJPEG}, ErrNotJPEG},
+		{"Short input", []byte{0xFF}, Error{Offset: 0, Marker: 0xD8, Reason: ReasonEOFInSegment}, ErrTruncated},
+		{"Bad length", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}, Error{Offset: 2, Marker: 0xE1, Reason: ReasonBadLength}, ErrTruncated},
+		{"EOF in segment", valid[:10], Error{Offset: 2, Marker: 0xE1, Reason: ReasonEOFInSegment}, ErrTruncated},
+		{"EOF in scan", valid[:len(valid)-3], Error{Offset: int64(len(valid) - 4), Marker: 0xDA, Reason: ReasonEOFInScan}, ErrTruncated},
+		{"Missing EOI", valid[:2+len(exif)], Error{Offset: int64(2 + len(exif)), Reason: ReasonMissingEOI}, ErrTruncated},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := strip(t, c.img)
+			if *e != c.want {
+				t.Fatalf("got %+v, want %+v", *e, c.want)
+			}
+			if !errors.Is(e, c.target) {
+				t.Fatalf("expected errors.Is(%v, %v)", e, c.target)
+			}
+		})
+	}
+
+	t.Run("Writer failure unwraps to the writer error", func(t *testing.T) {
+		err := Strip(bytes.NewReader(valid), &failingWriter{after: 2 + len(exif)}, NewPolicy())
+
+		var e *Error
+		if !errors.As(err, &e) || e.Reason != ReasonWrite || e.Marker != 0xDA || e.Offset != int64(2+len(exif)) {
+			t.Fatalf("unexpected error %#v", err)
+		}
+		if !errors.Is(err, errDiskFull) || errors.Is(err, ErrTruncated) {
+			t.Fatalf("expected only the writer error to match")
+		}
+	})
+
+	t.Run("Errors in secondary images point into the file", func(t *testing.T) {
+		src := makeMPFImage(nil, testutil.MakeJPEG(testutil.MakeSOS([]byte{0x33})))
+		mp, _ := parseMPF(src, newBudget(DefaultLimits))
+		// A zero length field in the secondary image, which still parses as
+		// an MPF target
+		broken := append(append([]byte{}, src[:mp.images[0].start+2]...), 0xFF, 0xFE, 0x00, 0x00)
+		broken = append(broken, src[mp.images[0].start+6:]...)
+
+		e := strip(t, broken)
+		if e.Reason != ReasonBadLength || e.Offset != int64(mp.images[0].start+2) {
+			t.Fatalf("unexpected error %+v", *e)
+		}
+	})
+
+	t.Run("Message names the place", func(t *testing.T) {
+		e := &Error{Offset: 20, Marker: 0xE1, Reason: ReasonBadLength}
+		if got := e.Error(); got != "segment length below 2 at offset 20 (APP1)" {
+			t.Fatalf("unexpected message %q", got)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package jpegstrip
+
+var exifPrefix = []byte("Exif\x00\x00")
+
+// ExifTag identifies a tag inside one of the EXIF directories. Removing a
+// pointer tag such as the GPS IFD pointer removes the whole directory.
+type ExifTag struct {
+	IFD IFD
+	Tag uint16
+}
+
+const tagMakerNote = 0x927C
+
+var (
+	ExifGPS              = ExifTag{IFD0, tagGPSIFD}
+	ExifMakerNote        = ExifTag{ExifIFD, tagMakerNote}
+	ExifBodySerialNumber = ExifTag{ExifIFD, 0xA431}
+	ExifLensSerialNumber = ExifTag{ExifIFD, 0xA435}
+	ExifCameraOwnerName  = ExifTag{ExifIFD, 0xA430}
+	ExifImageUniqueID    = ExifTag{ExifIFD, 0xA420}
+	ExifCameraSerial     = ExifTag{IFD0, 0xC62F} // DNG CameraSerialNumber, copied by some converters
+
+	ExifDateTime            = ExifTag{IFD0, 0x0132}
+	ExifDateTimeOriginal    = ExifTag{ExifIFD, 0x9003}
+	ExifDateTimeDigitized   = ExifTag{ExifIFD, 0x9004}
+	ExifOffsetTime          = ExifTag{ExifIFD, 0x9010}
+	ExifOffsetTimeOriginal  = ExifTag{ExifIFD, 0x9011}
+	ExifOffsetTimeDigitized = ExifTag{ExifIFD, 0x9012}
+	ExifSubSecTime          = ExifTag{ExifIFD, 0x9290}
+	ExifSubSecTimeOriginal  = ExifTag{ExifIFD, 0x9291}
+	ExifSubSecTimeDigitized = ExifTag{ExifIFD, 0x9292}
+)
+
+// Tags removed by the "exif:<name>" metadata types
+var exifTagGroups = map[string][]ExifTag{
+	"exif:gps":       {ExifGPS},
+	"exif:makernote": {ExifMakerNote},
+	"exif:serial":    {ExifBodySerialNumber, ExifLensSerialNumber, ExifCameraSerial},
+	// Everything that ties a photo to one camera or its owner
+	"exif:device": {
+		ExifMakerNote, ExifBodySerialNumber, ExifLensSerialNumber, ExifCameraSerial,
+		ExifCameraOwnerName, ExifImageUniqueID,
+	},
+	"exif:datetime": {
+		ExifDateTime, ExifDateTimeOriginal, ExifDateTimeDigitized,
+		ExifOffsetTime, ExifOffsetTimeOriginal, ExifOffsetTimeDigitized,
+		ExifSubSecTime, ExifSubSecTimeOriginal, ExifSubSecTimeDigitized,
+	},
+}
+
+// Rewrites an APP1 EXIF payload without the given tags. A payload that
+// cannot be parsed or no longer fits in a segment is dropped as a whole.
+func editExif(payload []byte, remove map[ExifTag]bool) ([]byte, bool) {
+	t, err := parseTIFF(payload[len(exifPrefix):])
+	if err != nil {
+		return nil, false
+	}
+
+	changed := false
+	for tag := range remove {
+		if ifd := t.ifd(tag.IFD); ifd != nil && ifd.remove(tag.Tag) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return payload, true
+	}
+
+	edited := append(append([]byte{}, exifPrefix...), t.encode()...)
+	if len(edited) > 0xFFFF-2 {
+		return nil, false
+	}
+	return edited, true
+}
@@ -0,0 +1,264 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func makeTestExif() testutil.Exif {
+	return testutil.Exif{
+		IFD0: []testutil.Tag{
+			testutil.ASCII(0x010F, "ACME"),
+			testutil.ASCII(0x0110, "Camera 3000"),
+			testutil.Short(0x0112, 6), // Orientation
+			testutil.ASCII(0x0132, "2024:05:06 07:08:09"),
+			testutil.ASCII(0x8298, "(c) Somebody"), // Copyright
+		},
+		Exif: []testutil.Tag{
+			testutil.ASCII(0x9003, "2024:05:06 07:08:09"),
+			testutil.Undefined(0x927C, []byte("MAKERNOTE-DATA-WITH-SECRETS")),
+			testutil.ASCII(0xA431, "BODY-SN-123456"),
+			testutil.ASCII(0xA435, "LENS-SN-654321"),
+		},
+		GPS: []testutil.Tag{
+			testutil.ASCII(0x0001, "N"),
+			testutil.Rational(0x0002, 52, 1, 31, 1, 1234, 100),
+		},
+		Thumbnail: []byte{0xFF, 0xD8, 't', 'h', 'u', 'm', 'b', 0xFF, 0xD9},
+	}
+}
+
+func mustParseExif(t *testing.T, payload []byte) *tiffFile {
+	t.Helper()
+	if !bytes.HasPrefix(payload, exifPrefix) {
+		t.Fatalf("payload has no EXIF header")
+	}
+	tf, err := parseTIFF(payload[len(exifPrefix):])
+	if err != nil {
+		t.Fatalf("parseTIFF() unexpected error: %v", err)
+	}
+	return tf
+}
+
+func TestParseTIFF(t *testing.T) {
+	t.Run("Parses sub-IFDs and thumbnail", func(t *testing.T) {
+		tf := mustParseExif(t, makeTestExif().Payload())
+
+		if e := tf.ifd(IFD0).find(0x0112); e == nil || tf.order.Uint16(e.value) != 6 {
+			t.Fatalf("Orientation not parsed")
+		}
+		if e := tf.ifd(ExifIFD).find(0x927C); e == nil || string(e.value) != "MAKERNOTE-DATA-WITH-SECRETS" {
+			t.Fatalf("MakerNote not parsed")
+		}
+		if tf.ifd(GPSIFD).find(0x0002) == nil {
+			t.Fatalf("GPS IFD not parsed")
+		}
+		e := tf.ifd(IFD1).find(0x0201)
+		if e == nil || len(e.blobs) != 1 || !bytes.Equal(e.blobs[0], makeTestExif().Thumbnail) {
+			t.Fatalf("thumbnail not parsed")
+		}
+	})
+
+	t.Run("Parses little-endian blocks", func(t *testing.T) {
+		var b bytes.Buffer
+		b.Write([]byte{'I', 'I', 0x2A, 0x00, 0x08, 0x00, 0x00, 0x00})
+		binary.Write(&b, binary.LittleEndian, uint16(1))
+		binary.Write(&b, binary.LittleEndian, []uint16{0x0112, typeShort})
+		binary.Write(&b, binary.LittleEndian, []uint32{1, 3, 0})
+
+		tf, err := parseTIFF(b.Bytes())
+		if err != nil {
+			t.Fatalf("parseTIFF() unexpected error: %v", err)
+		}
+		if e := tf.ifd0.find(0x0112); e == nil || tf.order.Uint16(e.value) != 3 {
+			t.Fatalf("Orientation not parsed from little-endian block")
+		}
+		if !bytes.Equal(tf.encode(), b.Bytes()) {
+			t.Fatalf("re-encoded block differs:\n got % X\nwant % X", tf.encode(), b.Bytes())
+		}
+	})
+
+	t.Run("Rejects bad header", func(t *testing.T) {
+		if _, err := parseTIFF([]byte("XX\x00\x2A\x00\x00\x00\x08")); err == nil {
+			t.Fatalf("expected error for bad byte order mark")
+		}
+	})
+
+	t.Run("Rejects IFD past the end", func(t *testing.T) {
+		if _, err := parseTIFF([]byte("MM\x00\x2A\x00\x00\x10\x00")); err == nil {
+			t.Fatalf("expected error for IFD offset past the end")
+		}
+	})
+
+	t.Run("Survives IFD loops", func(t *testing.T) {
+		e := testutil.Exif{IFD0: []testutil.Tag{testutil.Long(0x8769, 8)}}
+		tf, err := parseTIFF(e.TIFF())
+		if err != nil {
+			t.Fatalf("parseTIFF() unexpected error: %v", err)
+		}
+		if tf.ifd(ExifIFD) != nil {
+			t.Fatalf("expected looping Exif IFD pointer to be discarded")
+		}
+	})
+
+	t.Run("Encode round trip keeps every value", func(t *testing.T) {
+		orig := mustParseExif(t, makeTestExif().Payload())
+		again, err := parseTIFF(orig.encode())
+		if err != nil {
+			t.Fatalf("parseTIFF() of re-encoded block: %v", err)
+		}
+
+		for _, kind := range []IFD{IFD0, ExifIFD, GPSIFD, IFD1} {
+			want, got := orig.ifd(kind), again.ifd(kind)
+			if got == nil || len(got.entries) != len(want.entries) {
+				t.Fatalf("IFD %d: entry count mismatch", kind)
+			}
+			for _, e := range want.entries {
+				if e.sub != nil || len(e.blobs) > 0 {
+					continue
+				}
+				if g := got.find(e.tag); g == nil || !bytes.Equal(g.value, e.value) {
+					t.Fatalf("IFD %d tag %#04x: value mismatch", kind, e.tag)
+				}
+			}
+		}
+
+		if e := again.ifd(IFD1).find(0x0201); e == nil || !bytes.Equal(e.blobs[0], makeTestExif().Thumbnail) {
+			t.Fatalf("thumbnail lost in round trip")
+		}
+	})
+}
+
+func TestEditExif(t *testing.T) {
+	t.Run("Removes GPS IFD and keeps the rest", func(t *testing.T) {
+		edited, keep := editExif(makeTestExif().Payload(), map[ExifTag]bool{ExifGPS: true})
+		if !keep {
+			t.Fatalf("expected EXIF segment to be kept")
+		}
+
+		tf := mustParseExif(t, edited)
+		if tf.ifd(GPSIFD) != nil || tf.ifd0.find(tagGPSIFD) != nil {
+			t.Fatalf("GPS IFD not removed")
+		}
+		if e := tf.ifd0.find(0x0112); e == nil || tf.order.Uint16(e.value) != 6 {
+			t.Fatalf("Orientation not preserved")
+		}
+		if tf.ifd0.find(0x8298) == nil {
+			t.Fatalf("Copyright not preserved")
+		}
+		if e := tf.ifd(IFD1).find(0x0201); e == nil || !bytes.Equal(e.blobs[0], makeTestExif().Thumbnail) {
+			t.Fatalf("thumbnail not preserved")
+		}
+	})
+
+	t.Run("Removes tags from the Exif IFD", func(t *testing.T) {
+		remove := map[ExifTag]bool{ExifMakerNote: true, ExifBodySerialNumber: true, ExifDateTimeOriginal: true}
+		edited, _ := editExif(makeTestExif().Payload(), remove)
+
+		if bytes.Contains(edited, []byte("MAKERNOTE")) || bytes.Contains(edited, []byte("BODY-SN")) {
+			t.Fatalf("MakerNote or serial number not removed")
+		}
+		tf := mustParseExif(t, edited)
+		if tf.ifd(ExifIFD).find(0x9003) != nil {
+			t.Fatalf("DateTimeOriginal not removed")
+		}
+		if e := tf.ifd(ExifIFD).find(0xA435); e == nil || string(e.value) != "LENS-SN-654321\x00" {
+			t.Fatalf("LensSerialNumber not preserved")
+		}
+	})
+
+	t.Run("Unchanged payload is returned as is", func(t *testing.T) {
+		payload := testutil.Exif{IFD0: []testutil.Tag{testutil.Short(0x0112, 1)}}.Payload()
+		edited, keep := editExif(payload, map[ExifTag]bool{ExifGPS: true})
+		if !keep || !bytes.Equal(edited, payload) {
+			t.Fatalf("expected payload to be returned unchanged")
+		}
+	})
+
+	t.Run("Unparseable payload is dropped", func(t *testing.T) {
+		if _, keep := editExif([]byte("Exif\x00\x00garbage"), map[ExifTag]bool{ExifGPS: true}); keep {
+			t.Fatalf("expected malformed EXIF to be dropped")
+		}
+	})
+
+	t.Run("Maker note keeps its offset when possible", func(t *testing.T) {
+		payload := makeTestExif().Payload()
+		orig := mustParseExif(t, payload).ifd(ExifIFD).find(tagMakerNote).offset
+
+		edited, _ := editExif(payload, map[ExifTag]bool{ExifDateTime: true})
+		if got := mustParseExif(t, edited).ifd(ExifIFD).find(tagMakerNote).offset; got != orig {
+			t.Fatalf("MakerNote moved from %d to %d", orig, got)
+		}
+	})
+}
+
+func TestStripExifTags(t *testing.T) {
+	exif := testutil.MakeSegment(0xE1, makeTestExif().Payload())
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+
+	t.Run("exif:gps keeps the EXIF segment", func(t *testing.T) {
+		got := stripBytes(t, testutil.MakeJPEG(exif, sos), policyFor("exif:gps"))
+
+		if !bytes.Contains(got, exifPrefix) {
+			t.Fatalf("EXIF segment removed")
+		}
+		if bytes.Contains(got, []byte{0x00, 0x00, 0x00, 52, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 31}) {
+			t.Fatalf("GPS coordinates still present")
+		}
+	})
+
+	t.Run("exif wins over tag removal", func(t *testing.T) {
+		got := stripBytes(t, testutil.MakeJPEG(exif, sos), policyFor("exif:gps", "exif"))
+
+		if bytes.Contains(got, exifPrefix) {
+			t.Fatalf("EXIF segment not removed")
+		}
+	})
+
+	t.Run("Combined tag groups", func(t *testing.T) {
+		got := stripBytes(t, testutil.MakeJPEG(exif, sos), policyFor("exif:makernote", "exif:serial", "exif:datetime"))
+
+		for _, secret := range []string{"MAKERNOTE", "BODY-SN", "LENS-SN", "2024:05:06"} {
+			if bytes.Contains(got, []byte(secret)) {
+				t.Fatalf("%q still present", secret)
+			}
+		}
+		if !bytes.Contains(got, []byte("Camera 3000")) {
+			t.Fatalf("Model not preserved")
+		}
+	})
+	t.Run("exif:device removes what identifies the camera", func(t *testing.T) {
+		payload := testutil.Exif{
+			IFD0: []testutil.Tag{
+				testutil.ASCII(0x0110, "Camera 3000"),
+				testutil.ASCII(0xC62F, "DNG-SN"),
+			},
+			Exif: []testutil.Tag{
+				testutil.Undefined(tagMakerNote, []byte("MAKERNOTE shutter count 12345")),
+				testutil.ASCII(0x9003, "2024:05:06 07:08:09"),
+				testutil.ASCII(0xA420, "UNIQUE-ID"),
+				testutil.ASCII(0xA430, "OWNER"),
+				testutil.ASCII(0xA431, "BODY-SN"),
+				testutil.ASCII(0xA435, "LENS-SN"),
+			},
+			GPS: []testutil.Tag{testutil.ASCII(0x0001, "N")},
+		}.Payload()
+		got := stripBytes(t, testutil.MakeJPEG(testutil.MakeSegment(0xE1, payload), sos), policyFor("exif:device"))
+
+		for _, secret := range []string{"MAKERNOTE", "DNG-SN", "UNIQUE-ID", "OWNER", "BODY-SN", "LENS-SN"} {
+			if bytes.Contains(got, []byte(secret)) {
+				t.Fatalf("%q still present", secret)
+			}
+		}
+		tf := mustParseExif(t, got[bytes.Index(got, exifPrefix):])
+		if tf.ifd0.find(0x0110).str() != "Camera 3000" || tf.ifd(ExifIFD).find(0x9003).str() != "2024:05:06 07:08:09" {
+			t.Fatalf("expected the other tags to be kept")
+		}
+		if tf.ifd(GPSIFD).find(0x0001).str() != "N" {
+			t.Fatalf("expected the GPS IFD to be found after the rewrite")
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package jpegstrip
+
+import (
+	"maps"
+	"math"
+)
+
+const kmPerDegree = 111.32 // along a meridian, and along the equator
+
+// GPS tags that survive coarsening. Altitude, direction, speed, timestamps,
+// destinations and the rest say more than a rounded position would.
+var coarseGPSTags = map[uint16]bool{
+	0x0000: true, // GPSVersionID
+	0x0001: true, // GPSLatitudeRef
+	0x0002: true, // GPSLatitude
+	0x0003: true, // GPSLongitudeRef
+	0x0004: true, // GPSLongitude
+	0x0012: true, // GPSMapDatum
+}
+
+// Rounds the EXIF GPS position to a grid of roughly km kilometres and removes
+// every other GPS tag. The IFD is rewritten in place, so nothing else in the
+// EXIF data moves. A position that cannot be read is removed, and a payload
+// that cannot be parsed is dropped.
+func coarsenGPS(payload []byte, km float64) ([]byte, bool) {
+	out := append([]byte{}, payload...)
+	tiff := out[len(exifPrefix):]
+
+	t, err := parseTIFF(tiff)
+	if err != nil {
+		return nil, false
+	}
+	ptr := t.ifd0.find(tagGPSIFD)
+	gps := t.ifd(GPSIFD)
+	if ptr == nil || gps == nil {
+		return payload, true
+	}
+
+	keep := coarseGPSTags
+	lat, latOK := gpsCoordinate(t, gps, 0x0001, 0x0002)
+	lon, lonOK := gpsCoordinate(t, gps, 0x0003, 0x0004)
+	if latOK && lonOK {
+		step := km / kmPerDegree
+		lat = math.Max(-90, math.Min(90, math.Round(lat/step)*step))
+
+		// Meridians get closer towards the poles
+		lonStep := math.Min(360, km/(kmPerDegree*math.Max(math.Cos(lat*math.Pi/180), 0.01)))
+		lon = math.Round(lon/lonStep) * lonStep
+		lon = math.Mod(lon+540, 360) - 180
+
+		putGPSCoordinate(tiff, t, gps, 0x0001, 0x0002, lat, 'N', 'S')
+		putGPSCoordinate(tiff, t, gps, 0x0003, 0x0004, lon, 'E', 'W')
+	} else {
+		// A position that can't be rounded is removed, not kept as it is
+		keep = maps.Clone(coarseGPSTags)
+		for tag := uint16(0x0001); tag <= 0x0004; tag++ {
+			delete(keep, tag)
+		}
+	}
+
+	compactIFD(tiff, t, t.order.Uint32(ptr.value), keep)
+	return out, true
+}
+
+// Returns a signed coordinate in degrees from a reference and DMS tag pair
+func gpsCoordinate(t *tiffFile, gps *tiffIFD, refTag, tag uint16) (float64, bool) {
+	v := degrees(gps.find(tag).rationals(t.order))
+	if math.IsNaN(v) {
+		return 0, false
+	}
+	if ref := gps.find(refTag).str(); ref == "S" || ref == "W" {
+		v = -v
+	}
+	return v, true
+}
+
+// Overwrites a coordinate and its reference where they already are
+func putGPSCoordinate(tiff []byte, t *tiffFile, gps *tiffIFD, refTag, tag uint16, v float64, pos, neg byte) {
+	e := gps.find(tag)
+	if ref := gps.find(refTag); ref != nil && ref.typ == typeASCII && ref.count >= 1 && ref.count <= 4 {
+		if v < 0 {
+			tiff[ref.pos+8] = neg
+		} else {
+			tiff[ref.pos+8] = pos
+		}
+	}
+
+	v = math.Abs(v)
+	d := math.Floor(v)
+	m := math.Floor((v - d) * 60)
+	s := math.Round(((v-d)*60 - m) * 60 * 100)
+	if s >= 6000 {
+		s, m = 0, m+1
+	}
+	if m >= 60 {
+		m, d = 0, d+1
+	}
+
+	b := tiff[e.offset:]
+	for i, r := range [3][2]uint32{{uint32(d), 1}, {uint32(m), 1}, {uint32(s), 100}} {
+		t.order.PutUint32(b[8*i:], r[0])
+		t.order.PutUint32(b[8*i+4:], r[1])
+	}
+}
+
+// Removes the entries of the IFD at off whose tag is not in keep, without
+// moving the IFD. Entries are packed to the front, the values of removed
+// entries are zeroed and the space they leave is zeroed too.
+func compactIFD(tiff []byte, t *tiffFile, off uint32, keep map[uint16]bool) {
+	n := int(t.order.Uint16(tiff[off:]))
+	start := int(off) + 2
+	next := t.order.Uint32(tiff[start+12*n:])
+
+	var kept [][]byte
+	for i := 0; i < n; i++ {
+		raw := tiff[start+12*i : start+12*i+12]
+		if keep[t.order.Uint16(raw)] {
+			kept = append(kept, append([]byte{}, raw...))
+			continue
+		}
+
+		size := uint64(typeSize(t.order.Uint16(raw[2:]))) * uint64(t.order.Uint32(raw[4:]))
+		if size > 4 {
+			valueOff := uint64(t.order.Uint32(raw[8:]))
+			if valueOff+size <= uint64(len(tiff)) {
+				clear(tiff[valueOff : valueOff+size])
+			}
+		}
+	}
+
+	clear(tiff[start : start+12*n+4])
+	t.order.PutUint16(tiff[off:], uint16(len(kept)))
+	for i, raw := range kept {
+		copy(tiff[start+12*i:], raw)
+	}
+	t.order.PutUint32(tiff[start+12*len(kept):], next)
+}
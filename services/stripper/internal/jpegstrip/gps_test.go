@@ -0,0 +1,127 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func makeGPSExif(latRef, lonRef string) []byte {
+	return testutil.Exif{
+		IFD0: []testutil.Tag{testutil.ASCII(0x010F, "ACME")},
+		Exif: []testutil.Tag{testutil.Undefined(tagMakerNote, []byte("maker note data"))},
+		GPS: []testutil.Tag{
+			testutil.ASCII(0x0001, latRef),
+			testutil.Rational(0x0002, 52, 1, 31, 1, 1234, 100),
+			testutil.ASCII(0x0003, lonRef),
+			testutil.Rational(0x0004, 13, 1, 24, 1, 5678, 100),
+			testutil.Undefined(0x0005, []byte{0}),
+			testutil.Rational(0x0006, 345, 10),
+			testutil.Rational(0x0007, 14, 1, 30, 1, 5, 1),
+			testutil.ASCII(0x0010, "T"),
+			testutil.Rational(0x0011, 1234, 10),
+			testutil.ASCII(0x001D, "2024:05:01"),
+		},
+	}.Payload()
+}
+
+func TestCoarsenGPS(t *testing.T) {
+	payload := makeGPSExif("N", "E")
+
+	got, keep := coarsenGPS(payload, 10)
+	if !keep {
+		t.Fatalf("expected EXIF to be kept")
+	}
+	tf := mustParseExif(t, got)
+	gps := tf.ifd(GPSIFD)
+
+	t.Run("Position is on the grid", func(t *testing.T) {
+		pos := gpsPosition(tf)
+		if pos == nil {
+			t.Fatalf("expected a GPS position")
+		}
+
+		step := 10 / kmPerDegree
+		if r := math.Remainder(pos.Latitude, step); math.Abs(r) > 1e-5 {
+			t.Fatalf("latitude %f is not on the grid", pos.Latitude)
+		}
+		want := 52 + 31.0/60 + 12.34/3600
+		if math.Abs(pos.Latitude-want) > step/2+1e-5 || math.Abs(pos.Longitude-(13+24.0/60+56.78/3600)) > 0.1 {
+			t.Fatalf("position moved too far: %+v", pos)
+		}
+	})
+
+	t.Run("Other GPS tags are removed", func(t *testing.T) {
+		for _, tag := range []uint16{0x0005, 0x0006, 0x0007, 0x0010, 0x0011, 0x001D} {
+			if gps.find(tag) != nil {
+				t.Fatalf("GPS tag 0x%04X not removed", tag)
+			}
+		}
+		if len(gps.entries) != 4 {
+			t.Fatalf("expected 4 GPS tags left, got %d", len(gps.entries))
+		}
+	})
+
+	t.Run("Nothing else moves", func(t *testing.T) {
+		if len(got) != len(payload) {
+			t.Fatalf("payload size changed from %d to %d", len(payload), len(got))
+		}
+		if !bytes.Contains(got, []byte("maker note data")) || tf.ifd0.find(0x010F).str() != "ACME" {
+			t.Fatalf("expected the rest of EXIF to be kept")
+		}
+		if bytes.Contains(got, []byte("2024:05:01")) {
+			t.Fatalf("expected removed values to be cleared")
+		}
+	})
+
+	t.Run("Southern and western positions keep their sign", func(t *testing.T) {
+		got, _ := coarsenGPS(makeGPSExif("S", "W"), 10)
+
+		pos := gpsPosition(mustParseExif(t, got))
+		if pos == nil || pos.Latitude > -52 || pos.Longitude > -13 {
+			t.Fatalf("unexpected position %+v", pos)
+		}
+	})
+
+	t.Run("Unreadable position is removed", func(t *testing.T) {
+		lon := testutil.Rational(0x0004, 13, 1, 24, 1, 5678, 100)
+		exif := testutil.Exif{GPS: []testutil.Tag{
+			testutil.Undefined(0x0000, []byte{2, 3, 0, 0}),
+			testutil.ASCII(0x0001, "N"),
+			testutil.Rational(0x0002, 52, 1, 31, 0, 1234, 100), // zero denominator
+			testutil.ASCII(0x0003, "E"),
+			lon,
+		}}.Payload()
+
+		got, keep := coarsenGPS(exif, 10)
+		if !keep {
+			t.Fatalf("expected EXIF to be kept")
+		}
+		gps := mustParseExif(t, got).ifd(GPSIFD)
+		if len(gps.entries) != 1 || gps.find(0x0000) == nil {
+			t.Fatalf("expected only GPSVersionID to be left, got %d tags", len(gps.entries))
+		}
+		if bytes.Contains(got, lon.Value) {
+			t.Fatalf("expected the longitude to be cleared")
+		}
+	})
+
+	t.Run("Selected through gps:coarsen", func(t *testing.T) {
+		img := testutil.MakeJPEG(testutil.MakeSegment(0xE1, payload), testutil.MakeSOS([]byte{0x11}))
+		out := stripBytes(t, img, policyFor("gps:coarsen=10"))
+
+		if !bytes.Contains(out, got) {
+			t.Fatalf("expected coarsened EXIF in output")
+		}
+	})
+
+	t.Run("Invalid sizes are rejected", func(t *testing.T) {
+		for _, v := range []string{"gps:coarsen=", "gps:coarsen=0", "gps:coarsen=-5", "gps:coarsen=abc", "gps:coarsen=NaN"} {
+			if NewPolicy().AddType(v) {
+				t.Fatalf("expected %q to be rejected", v)
+			}
+		}
+	})
+}
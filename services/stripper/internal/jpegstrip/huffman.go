@@ -0,0 +1,341 @@
+package jpegstrip
+
+import "errors"
+
+var errBadHuffman = errors.New("malformed Huffman data")
+
+// Maps the zigzag index of a coefficient to its natural (row-major) index
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// huffTable holds a table as stored in DHT along with the derived decoding
+// and encoding tables.
+type huffTable struct {
+	counts [16]byte // number of codes of each length 1..16
+	values []byte
+
+	// decoding: codes of length l+1 range over [minCode[l], maxCode[l]]
+	minCode [16]int32
+	maxCode [16]int32
+	valPtr  [16]int32
+
+	// encoding: code and length per symbol
+	code [256]uint16
+	size [256]byte
+}
+
+func newHuffTable(counts [16]byte, values []byte) (*huffTable, error) {
+	total := 0
+	for _, c := range counts {
+		total += int(c)
+	}
+	if total > 256 || total != len(values) {
+		return nil, errBadHuffman
+	}
+
+	h := &huffTable{counts: counts, values: values}
+
+	code, k := int32(0), int32(0)
+	for l := 0; l < 16; l++ {
+		n := int32(counts[l])
+		h.valPtr[l] = k
+		h.minCode[l] = code
+		h.maxCode[l] = code + n - 1
+		for i := int32(0); i < n; i++ {
+			h.code[values[k+i]] = uint16(code + i)
+			h.size[values[k+i]] = byte(l + 1)
+		}
+		code += n
+		k += n
+		// Codes of one length must all fit in that many bits
+		if code > 1<<(l+1) {
+			return nil, errBadHuffman
+		}
+		code <<= 1
+	}
+
+	return h, nil
+}
+
+// Parses a DHT payload into its tables, keyed by class (0 DC, 1 AC) and ID
+func parseDHT(payload []byte, fn func(class, id byte, t *huffTable)) error {
+	for len(payload) > 0 {
+		if len(payload) < 17 {
+			return errBadHuffman
+		}
+		class, id := payload[0]>>4, payload[0]&0x0F
+		if class > 1 || id > 3 {
+			return errBadHuffman
+		}
+
+		var counts [16]byte
+		copy(counts[:], payload[1:17])
+		n := 0
+		for _, c := range counts {
+			n += int(c)
+		}
+		if len(payload) < 17+n {
+			return errBadHuffman
+		}
+
+		t, err := newHuffTable(counts, append([]byte{}, payload[17:17+n]...))
+		if err != nil {
+			return err
+		}
+		fn(class, id, t)
+		payload = payload[17+n:]
+	}
+	return nil
+}
+
+// Builds a table with optimal code lengths for the given symbol frequencies,
+// limited to 16 bits as in the JPEG specification, Annex K.2.
+func optimalHuffTable(freq *[256]int) *huffTable {
+	var f [257]int
+	copy(f[:], freq[:])
+	f[256] = 1 // reserves the all-ones code point
+
+	used := false
+	for _, n := range freq {
+		used = used || n > 0
+	}
+	if !used {
+		f[0] = 1
+	}
+
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		c1, c2 := -1, -1
+		v := int(^uint(0) >> 1)
+		for i := 0; i <= 256; i++ {
+			if f[i] > 0 && f[i] <= v {
+				v, c1 = f[i], i
+			}
+		}
+		v = int(^uint(0) >> 1)
+		for i := 0; i <= 256; i++ {
+			if f[i] > 0 && f[i] <= v && i != c1 {
+				v, c2 = f[i], i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+
+		f[c1] += f[c2]
+		f[c2] = 0
+
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	var bits [33]int
+	for i := 0; i <= 256; i++ {
+		if codeSize[i] > 0 {
+			bits[codeSize[i]]++
+		}
+	}
+
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	var counts [16]byte
+	for l := 1; l <= 16; l++ {
+		counts[l-1] = byte(bits[l])
+	}
+
+	var values []byte
+	for l := 1; l <= 32; l++ {
+		for s := 0; s < 256; s++ {
+			if codeSize[s] == l {
+				values = append(values, byte(s))
+			}
+		}
+	}
+
+	// Lengths were only adjusted per count, so values are taken in order
+	total := 0
+	for _, c := range counts {
+		total += int(c)
+	}
+	values = values[:total]
+
+	t, _ := newHuffTable(counts, values)
+	return t
+}
+
+// Appends a DHT table definition to b
+func appendDHT(b []byte, class, id byte, t *huffTable) []byte {
+	b = append(b, class<<4|id)
+	b = append(b, t.counts[:]...)
+	return append(b, t.values...)
+}
+
+// bitReader reads entropy-coded data, removing stuffed zero bytes. Reaching
+// a marker or the end of the data yields zero bits, but reading into them
+// sets overrun: a complete scan never needs them.
+type bitReader struct {
+	data    []byte
+	pos     int
+	acc     uint32
+	n       uint
+	pad     uint // zero bits at the end of acc that are not in the data
+	overrun bool
+}
+
+func (br *bitReader) fill() {
+	for br.n <= 24 {
+		var b byte
+		if br.pos < len(br.data) {
+			b = br.data[br.pos]
+			if b == 0xFF {
+				if br.pos+1 < len(br.data) && br.data[br.pos+1] == 0x00 {
+					br.pos += 2
+				} else {
+					b = 0 // marker: stays in place and feeds zeros
+					br.pad += 8
+				}
+			} else {
+				br.pos++
+			}
+		} else {
+			br.pad += 8
+		}
+		br.acc |= uint32(b) << (24 - br.n)
+		br.n += 8
+	}
+}
+
+func (br *bitReader) bits(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	if br.n < n {
+		br.fill()
+	}
+	if n > br.n-br.pad {
+		br.overrun = true
+	}
+	v := int32(br.acc >> (32 - n))
+	br.acc <<= n
+	br.n -= n
+	br.pad = min(br.pad, br.n)
+	return v
+}
+
+func (br *bitReader) decode(h *huffTable) (byte, error) {
+	code := int32(0)
+	for l := 0; l < 16; l++ {
+		code = code<<1 | br.bits(1)
+		if h.counts[l] > 0 && code <= h.maxCode[l] && code >= h.minCode[l] {
+			return h.values[h.valPtr[l]+code-h.minCode[l]], nil
+		}
+	}
+	return 0, errBadHuffman
+}
+
+// Reads s magnitude bits and sign-extends them, Annex F.2.2.1
+func (br *bitReader) receiveExtend(s byte) int32 {
+	if s == 0 {
+		return 0
+	}
+	v := br.bits(uint(s))
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v
+}
+
+// Drops buffered bits and skips the RSTn marker at the current position
+func (br *bitReader) restart() error {
+	br.acc, br.n, br.pad = 0, 0, 0
+	for br.pos < len(br.data) && br.data[br.pos] == 0xFF {
+		br.pos++
+	}
+	if br.pos >= len(br.data) || br.data[br.pos] < 0xD0 || br.data[br.pos] > 0xD7 {
+		return errBadHuffman
+	}
+	br.pos++
+	return nil
+}
+
+// bitWriter produces entropy-coded data with byte stuffing
+type bitWriter struct {
+	out []byte
+	acc uint32
+	n   uint
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.acc = bw.acc<<n | v&(1<<n-1)
+	bw.n += n
+	for bw.n >= 8 {
+		b := byte(bw.acc >> (bw.n - 8))
+		bw.out = append(bw.out, b)
+		if b == 0xFF {
+			bw.out = append(bw.out, 0x00)
+		}
+		bw.n -= 8
+	}
+}
+
+// Pads the last byte with one bits
+func (bw *bitWriter) flush() {
+	if bw.n > 0 {
+		bw.write(1<<(8-bw.n)-1, 8-bw.n)
+	}
+}
+
+// Returns the magnitude category of v and its bit pattern, Annex F.1.2.1
+func magnitude(v int32) (byte, uint32) {
+	a := v
+	if a < 0 {
+		a = -a
+		v--
+	}
+	s := byte(0)
+	for a > 0 {
+		s++
+		a >>= 1
+	}
+	return s, uint32(v) & (1<<s - 1)
+}
@@ -0,0 +1,378 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+var (
+	xmpPrefix   = []byte("http://ns.adobe.com/xap/1.0/")
+	iccPrefix   = []byte("ICC_PROFILE\x00")
+	mpfPrefix   = []byte("MPF\x00")
+	fpxrPrefix  = []byte("FPXR\x00")
+	jfifPrefix  = []byte("JFIF\x00")
+	adobePrefix = []byte("Adobe")
+)
+
+// Kind classifies what a segment carries
+type Kind string
+
+const (
+	KindEXIF        Kind = "EXIF"
+	KindXMP         Kind = "XMP"
+	KindExtendedXMP Kind = "ExtendedXMP"
+	KindICC         Kind = "ICC"
+	KindIPTC        Kind = "IPTC"
+	KindComment     Kind = "COM"
+	KindMPF         Kind = "MPF"
+	KindFPXR        Kind = "FPXR"
+	KindJFIF        Kind = "JFIF"
+	KindJFXX        Kind = "JFXX" // JFIF extension holding a thumbnail
+	KindJUMBF       Kind = "JUMBF"
+	KindAdobe       Kind = "Adobe"
+	KindImage       Kind = "image" // frame, tables and scans needed to decode the picture
+	KindUnknown     Kind = "unknown"
+)
+
+func classify(marker byte, payload []byte) Kind {
+	switch {
+	case marker == 0xE0 && bytes.HasPrefix(payload, jfifPrefix):
+		return KindJFIF
+	case marker == 0xE0 && bytes.HasPrefix(payload, jfxxPrefix):
+		return KindJFXX
+	case marker == 0xE1 && bytes.HasPrefix(payload, exifPrefix):
+		return KindEXIF
+	case marker == 0xE1 && bytes.HasPrefix(payload, xmpPrefix):
+		return KindXMP
+	case marker == 0xE1 && bytes.HasPrefix(payload, xmpExtensionPrefix):
+		return KindExtendedXMP
+	case marker == 0xE2 && bytes.HasPrefix(payload, iccPrefix):
+		return KindICC
+	case marker == 0xE2 && bytes.HasPrefix(payload, mpfPrefix):
+		return KindMPF
+	case marker == 0xE2 && bytes.HasPrefix(payload, fpxrPrefix):
+		return KindFPXR
+	case marker == 0xEB && bytes.HasPrefix(payload, jumbfPrefix):
+		return KindJUMBF
+	case marker == 0xED && bytes.HasPrefix(payload, photoshopPrefix):
+		return KindIPTC
+	case marker == 0xEE && bytes.HasPrefix(payload, adobePrefix):
+		return KindAdobe
+	case marker == 0xFE:
+		return KindComment
+	case isImageMarker(marker):
+		return KindImage
+	default:
+		return KindUnknown
+	}
+}
+
+// Reports whether a marker belongs to the coded picture rather than metadata
+func isImageMarker(marker byte) bool {
+	switch {
+	case marker >= 0xC0 && marker <= 0xCF && marker != 0xC8: // SOFn, DHT, DAC
+		return true
+	case marker >= 0xD0 && marker <= 0xD9: // RSTn, SOI, EOI
+		return true
+	case marker >= 0xDA && marker <= 0xDD: // SOS, DQT, DNL, DRI
+		return true
+	default:
+		return false
+	}
+}
+
+func markerName(marker byte) string {
+	switch {
+	case marker >= 0xE0 && marker <= 0xEF:
+		return fmt.Sprintf("APP%d", marker-0xE0)
+	case marker >= 0xD0 && marker <= 0xD7:
+		return fmt.Sprintf("RST%d", marker-0xD0)
+	case marker == 0xC4:
+		return "DHT"
+	case marker == 0xC8:
+		return "JPG"
+	case marker == 0xCC:
+		return "DAC"
+	case marker >= 0xC0 && marker <= 0xCF:
+		return fmt.Sprintf("SOF%d", marker-0xC0)
+	}
+
+	switch marker {
+	case 0xD8:
+		return "SOI"
+	case 0xD9:
+		return "EOI"
+	case 0xDA:
+		return "SOS"
+	case 0xDB:
+		return "DQT"
+	case 0xDC:
+		return "DNL"
+	case 0xDD:
+		return "DRI"
+	case 0xFE:
+		return "COM"
+	default:
+		return fmt.Sprintf("0x%02X", marker)
+	}
+}
+
+// Report describes the segments of a JPEG and the metadata worth knowing about
+type Report struct {
+	Width      int           `json:"width,omitempty"`
+	Height     int           `json:"height,omitempty"`
+	Segments   []SegmentInfo `json:"segments"`
+	Trailer    *Trailer      `json:"trailer,omitempty"` // bytes after EOI
+	Thumbnail  *Thumbnail    `json:"thumbnail,omitempty"`
+	Repairs    []Repair      `json:"repairs,omitempty"` // what the parse mode fixed to read the file
+	Highlights Highlights    `json:"highlights"`
+}
+
+type SegmentInfo struct {
+	Marker byte   `json:"marker"`
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"` // bytes in the file, marker and length field included
+	Type   Kind   `json:"type"`
+	Chunk  *Chunk `json:"chunk,omitempty"` // position within data split over several segments
+	Label  string `json:"label,omitempty"` // JUMBF box label, such as c2pa
+}
+
+// Chunk places one segment in a sequence, as ICC profiles and extended XMP
+// larger than a segment are split into chunks
+type Chunk struct {
+	Group string `json:"group,omitempty"` // extended XMP GUID or JUMBF box instance
+	Seq   int    `json:"seq"`             // 1-based
+	Count int    `json:"count"`
+}
+
+// Returns the sequence number and chunk count of an APP2 ICC payload
+func iccChunk(payload []byte) (*Chunk, bool) {
+	if !bytes.HasPrefix(payload, iccPrefix) || len(payload) < len(iccPrefix)+2 {
+		return nil, false
+	}
+	c := &Chunk{Seq: int(payload[len(iccPrefix)]), Count: int(payload[len(iccPrefix)+1])}
+	if c.Seq < 1 || c.Seq > c.Count {
+		return nil, false
+	}
+	return c, true
+}
+
+// Highlights are the decoded metadata values that identify a person,
+// a device, a place or a moment
+type Highlights struct {
+	Make              string       `json:"make,omitempty"`
+	Model             string       `json:"model,omitempty"`
+	LensModel         string       `json:"lensModel,omitempty"`
+	SerialNumber      string       `json:"serialNumber,omitempty"`
+	Software          string       `json:"software,omitempty"`
+	Artist            string       `json:"artist,omitempty"`
+	Copyright         string       `json:"copyright,omitempty"`
+	DateTime          string       `json:"dateTime,omitempty"`
+	DateTimeOriginal  string       `json:"dateTimeOriginal,omitempty"`
+	DateTimeDigitized string       `json:"dateTimeDigitized,omitempty"`
+	Orientation       int          `json:"orientation,omitempty"`
+	GPS               *GPSPosition `json:"gps,omitempty"`
+	Comments          []string     `json:"comments,omitempty"`
+}
+
+type GPSPosition struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// Inspect walks the segments of a JPEG with the same marker logic Strip
+// uses and describes what it finds, without changing anything.
+func Inspect(in io.Reader) (*Report, error) {
+	return InspectMode(in, ParseDefault, DefaultLimits)
+}
+
+// InspectMode is Inspect reading the file in the given parse mode and within
+// the given limits, where zero fields take DefaultLimits. The report lists
+// what was repaired to get through it.
+func InspectMode(in io.Reader, mode ParseMode, limits Limits) (*Report, error) {
+	// The main image is decoded again to compare it with the thumbnail
+	limits = limits.withDefaults()
+	file, err := readLimited(in, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := newSegmentReader(bytes.NewReader(file))
+	sr.mode, sr.budget = mode, newBudget(limits)
+	if err := sr.readSOI(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{Segments: []SegmentInfo{{Marker: 0xD8, Name: "SOI", Length: 2, Type: KindImage}}}
+	exifSeen := false
+	var thumb []byte
+	xmpChunks := make(map[string][]xmpChunk)
+	jumbfChunks := make(map[uint16][]jumbfChunk)
+
+	for {
+		seg, err := sr.next()
+		if err != nil {
+			return nil, err
+		}
+
+		kind := classify(seg.marker, seg.payload)
+		info := SegmentInfo{
+			Marker: seg.marker,
+			Name:   markerName(seg.marker),
+			Offset: seg.offset,
+			Length: seg.size(),
+			Type:   kind,
+		}
+		if kind == KindICC {
+			info.Chunk, _ = iccChunk(seg.payload)
+		}
+		if ext, ok := parseExtendedXMP(seg.payload); ok && kind == KindExtendedXMP {
+			info.Chunk = &Chunk{Group: ext.guid}
+			xmpChunks[ext.guid] = append(xmpChunks[ext.guid], xmpChunk{ext.offset, info.Chunk})
+		}
+		if packet, ok := parseJUMBF(seg.payload); ok && kind == KindJUMBF {
+			info.Chunk = &Chunk{Group: jumbfGroup(packet.instance)}
+			jumbfChunks[packet.instance] = append(jumbfChunks[packet.instance], jumbfChunk{packet, len(report.Segments)})
+		}
+		report.Segments = append(report.Segments, info)
+
+		switch {
+		case kind == KindEXIF && !exifSeen:
+			exifSeen = true
+			report.Highlights.addExif(seg.payload)
+			thumb = exifThumbnail(seg.payload)
+		case kind == KindComment:
+			report.Highlights.Comments = append(report.Highlights.Comments, string(seg.payload))
+		case isFrameMarker(seg.marker) && len(seg.payload) >= 5:
+			report.Height = int(binary.BigEndian.Uint16(seg.payload[1:]))
+			report.Width = int(binary.BigEndian.Uint16(seg.payload[3:]))
+		}
+
+		switch seg.marker {
+		case 0xD9:
+			numberXMPChunks(xmpChunks)
+			numberJUMBFChunks(report.Segments, jumbfChunks)
+			if thumb != nil {
+				report.Thumbnail = checkThumbnail(thumb, file, report.Width, report.Height, sr.budget.Limits)
+			}
+			report.Trailer, err = readTrailer(sr)
+			if err != nil {
+				return nil, err
+			}
+			report.Repairs = sr.repairs
+			return report, nil
+		case 0xDA:
+			err = sr.copyEntropy(io.Discard)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+type xmpChunk struct {
+	offset uint32
+	chunk  *Chunk
+}
+
+// Numbers the chunks of every extended XMP packet by their offset, as the
+// segments don't have to be in order
+func numberXMPChunks(groups map[string][]xmpChunk) {
+	for _, chunks := range groups {
+		sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].offset < chunks[j].offset })
+		for i, c := range chunks {
+			c.chunk.Seq, c.chunk.Count = i+1, len(chunks)
+		}
+	}
+}
+
+// Reports whether the marker starts a frame (SOF0-SOF15 minus DHT, JPG and DAC)
+func isFrameMarker(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+func (h *Highlights) addExif(payload []byte) {
+	t, err := parseTIFF(payload[len(exifPrefix):])
+	if err != nil {
+		return
+	}
+
+	ifd0, exif := t.ifd(IFD0), t.ifd(ExifIFD)
+	h.Make = ifd0.find(0x010F).str()
+	h.Model = ifd0.find(0x0110).str()
+	h.Software = ifd0.find(0x0131).str()
+	h.Artist = ifd0.find(0x013B).str()
+	h.Copyright = ifd0.find(0x8298).str()
+	h.DateTime = ifd0.find(0x0132).str()
+	h.DateTimeOriginal = exif.find(0x9003).str()
+	h.DateTimeDigitized = exif.find(0x9004).str()
+	h.LensModel = exif.find(0xA434).str()
+	h.SerialNumber = exif.find(0xA431).str()
+	h.Orientation = exifOrientation(payload)
+	h.GPS = gpsPosition(t)
+}
+
+// Returns the text of an ASCII entry without its terminating NULs
+func (e *tiffEntry) str() string {
+	if e == nil || (e.typ != typeASCII && e.typ != typeUndefined) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (e *tiffEntry) rationals(order binary.ByteOrder) []float64 {
+	if e == nil || e.typ != typeRational {
+		return nil
+	}
+	vals := make([]float64, e.count)
+	for i := range vals {
+		num := order.Uint32(e.value[8*i:])
+		den := order.Uint32(e.value[8*i+4:])
+		if den == 0 {
+			return nil
+		}
+		vals[i] = float64(num) / float64(den)
+	}
+	return vals
+}
+
+func gpsPosition(t *tiffFile) *GPSPosition {
+	gps := t.ifd(GPSIFD)
+	lat := degrees(gps.find(0x0002).rationals(t.order))
+	lon := degrees(gps.find(0x0004).rationals(t.order))
+	if math.IsNaN(lat) || math.IsNaN(lon) {
+		return nil
+	}
+
+	if gps.find(0x0001).str() == "S" {
+		lat = -lat
+	}
+	if gps.find(0x0003).str() == "W" {
+		lon = -lon
+	}
+	pos := &GPSPosition{Latitude: lat, Longitude: lon}
+
+	if alt := gps.find(0x0006).rationals(t.order); len(alt) == 1 {
+		a := alt[0]
+		if ref := gps.find(0x0005); ref != nil && len(ref.value) == 1 && ref.value[0] == 1 {
+			a = -a
+		}
+		pos.Altitude = &a
+	}
+	return pos
+}
+
+// Converts degrees, minutes and seconds to decimal degrees
+func degrees(dms []float64) float64 {
+	if len(dms) != 3 {
+		return math.NaN()
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600
+}
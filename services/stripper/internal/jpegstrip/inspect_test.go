@@ -0,0 +1,145 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestInspect(t *testing.T) {
+	exif := testutil.MakeSegment(0xE1, testutil.Exif{
+		IFD0: []testutil.Tag{
+			testutil.ASCII(0x010F, "ACME"),
+			testutil.ASCII(0x0110, "Snap 3000"),
+			testutil.Short(0x0112, 6),
+			testutil.ASCII(0x0132, "2024:05:01 10:00:00"),
+		},
+		Exif: []testutil.Tag{testutil.ASCII(0x9003, "2024:05:01 09:59:58")},
+		GPS: []testutil.Tag{
+			testutil.ASCII(0x0001, "N"),
+			testutil.Rational(0x0002, 52, 1, 30, 1, 36, 1),
+			testutil.ASCII(0x0003, "W"),
+			testutil.Rational(0x0004, 13, 1, 15, 1, 0, 1),
+			testutil.Undefined(0x0005, []byte{0}),
+			testutil.Rational(0x0006, 345, 10),
+		},
+	}.Payload())
+	xmp := testutil.MakeSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	icc := testutil.MakeSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	iptc := makePhotoshopSegment(makeResource(ResourceIPTC, []byte{0x1C, 0x02, 0x05}))
+	mpf := testutil.MakeSegment(0xE2, []byte("MPF\x00II*\x00"))
+	com := testutil.MakeSegment(0xFE, []byte("hello"))
+	app9 := testutil.MakeSegment(0xE9, []byte("vendor"))
+	sof := testutil.MakeSegment(0xC0, []byte{8, 0, 16, 0, 24, 1, 1, 0x11, 0})
+	img := testutil.MakeJPEG(exif, xmp, icc, iptc, mpf, com, app9, sof, testutil.MakeSOS([]byte{0x11, 0x22}))
+
+	report, err := Inspect(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+
+	t.Run("Segments are classified with their offsets", func(t *testing.T) {
+		want := []struct {
+			name string
+			kind Kind
+			size int
+		}{
+			{"SOI", KindImage, 2},
+			{"APP1", KindEXIF, len(exif)},
+			{"APP1", KindXMP, len(xmp)},
+			{"APP2", KindICC, len(icc)},
+			{"APP13", KindIPTC, len(iptc)},
+			{"APP2", KindMPF, len(mpf)},
+			{"COM", KindComment, len(com)},
+			{"APP9", KindUnknown, len(app9)},
+			{"SOF0", KindImage, len(sof)},
+			{"SOS", KindImage, 9},
+		}
+		if len(report.Segments) != len(want)+1 {
+			t.Fatalf("expected %d segments, got %d", len(want)+1, len(report.Segments))
+		}
+
+		offset := int64(0)
+		for i, w := range want {
+			got := report.Segments[i]
+			if got.Name != w.name || got.Type != w.kind || got.Offset != offset {
+				t.Fatalf("segment %d: got %+v, want %s %s at %d", i, got, w.name, w.kind, offset)
+			}
+			if got.Length != w.size {
+				t.Fatalf("segment %d: length %d, want %d", i, got.Length, w.size)
+			}
+			offset += int64(got.Length)
+		}
+
+		// EOI follows the entropy-coded data of the scan
+		if eoi := report.Segments[len(want)]; eoi.Name != "EOI" || eoi.Offset != int64(len(img)-2) {
+			t.Fatalf("unexpected last segment %+v", eoi)
+		}
+	})
+
+	t.Run("ICC chunks are numbered", func(t *testing.T) {
+		c := report.Segments[3].Chunk
+		if c == nil || c.Seq != 1 || c.Count != 1 {
+			t.Fatalf("unexpected chunk %+v", c)
+		}
+		if report.Segments[5].Chunk != nil {
+			t.Fatalf("unexpected chunk on MPF segment")
+		}
+	})
+
+	t.Run("Highlights are decoded", func(t *testing.T) {
+		h := report.Highlights
+		if h.Make != "ACME" || h.Model != "Snap 3000" || h.Orientation != 6 {
+			t.Fatalf("unexpected camera fields %+v", h)
+		}
+		if h.DateTime != "2024:05:01 10:00:00" || h.DateTimeOriginal != "2024:05:01 09:59:58" {
+			t.Fatalf("unexpected timestamps %+v", h)
+		}
+		if len(h.Comments) != 1 || h.Comments[0] != "hello" {
+			t.Fatalf("unexpected comments %q", h.Comments)
+		}
+		if report.Width != 24 || report.Height != 16 {
+			t.Fatalf("expected 24x16, got %dx%d", report.Width, report.Height)
+		}
+	})
+
+	t.Run("GPS position is signed by its references", func(t *testing.T) {
+		gps := report.Highlights.GPS
+		if gps == nil {
+			t.Fatalf("expected a GPS position")
+		}
+		if math.Abs(gps.Latitude-52.51) > 1e-9 || math.Abs(gps.Longitude+13.25) > 1e-9 {
+			t.Fatalf("unexpected position %+v", gps)
+		}
+		if gps.Altitude == nil || *gps.Altitude != 34.5 {
+			t.Fatalf("unexpected altitude %v", gps.Altitude)
+		}
+	})
+
+	t.Run("Images without EXIF have no highlights", func(t *testing.T) {
+		report, err := Inspect(bytes.NewReader(testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11}))))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		if report.Highlights.Make != "" || report.Highlights.GPS != nil {
+			t.Fatalf("unexpected highlights %+v", report.Highlights)
+		}
+	})
+
+	t.Run("Truncated segment returns ErrTruncated", func(t *testing.T) {
+		_, err := Inspect(bytes.NewReader([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x10, 'E'}))
+		if !errors.Is(err, ErrTruncated) {
+			t.Fatalf("expected ErrTruncated, got %v", err)
+		}
+	})
+
+	t.Run("Non-JPEG returns ErrNotJPEG", func(t *testing.T) {
+		_, err := Inspect(bytes.NewReader([]byte("GIF89a")))
+		if !errors.Is(err, ErrNotJPEG) {
+			t.Fatalf("expected ErrNotJPEG, got %v", err)
+		}
+	})
+}
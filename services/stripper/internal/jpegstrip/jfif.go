@@ -0,0 +1,22 @@
+package jpegstrip
+
+var jfxxPrefix = []byte("JFXX\x00")
+
+// Length of a JFIF APP0 payload up to the thumbnail: identifier, version,
+// density units, X and Y density and the thumbnail size
+const jfifHeaderSize = 14
+
+// Rewrites an APP0 JFIF payload as a plain header with a 0x0 thumbnail. A
+// payload too short to hold the header is dropped.
+func plainJFIF(payload []byte) ([]byte, bool) {
+	if len(payload) < jfifHeaderSize {
+		return nil, false
+	}
+	if len(payload) == jfifHeaderSize && payload[12] == 0 && payload[13] == 0 {
+		return payload, true
+	}
+
+	out := append([]byte{}, payload[:jfifHeaderSize]...)
+	out[12], out[13] = 0, 0
+	return out, true
+}
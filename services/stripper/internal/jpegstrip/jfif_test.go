@@ -0,0 +1,60 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestJFIFThumbnail(t *testing.T) {
+	// 2x1 RGB thumbnail after a 72 dpi header
+	header := []byte("JFIF\x00\x01\x02\x01\x00\x48\x00\x48")
+	jfif := testutil.MakeSegment(0xE0, append(append([]byte{}, header...), 2, 1, 'R', 'G', 'B', 'r', 'g', 'b'))
+	jfxx := testutil.MakeSegment(0xE0, []byte("JFXX\x00\x10\xFF\xD8\xFF\xD9"))
+	sof := testutil.MakeSegment(0xC0, []byte{0x08, 0x00, 0x10, 0x00, 0x10, 0x01, 0x01, 0x11, 0x00})
+	sos := testutil.MakeSOS([]byte{0x11})
+	plain := testutil.MakeSegment(0xE0, append(append([]byte{}, header...), 0, 0))
+
+	t.Run("jfif:thumbnail keeps a plain header", func(t *testing.T) {
+		got := stripBytes(t, testutil.MakeJPEG(jfif, jfxx, sof, sos), policyFor("jfif:thumbnail"))
+
+		if want := testutil.MakeJPEG(plain, sof, sos); !bytes.Equal(got, want) {
+			t.Fatalf("got %X, want %X", got, want)
+		}
+	})
+
+	t.Run("Plain header is left alone", func(t *testing.T) {
+		img := testutil.MakeJPEG(plain, sof, sos)
+		if got := stripBytes(t, img, policyFor("jfif:thumbnail")); !bytes.Equal(got, img) {
+			t.Fatalf("expected the image to be unchanged")
+		}
+	})
+
+	t.Run("Short header is dropped", func(t *testing.T) {
+		got := stripBytes(t, testutil.MakeJPEG(testutil.MakeSegment(0xE0, []byte("JFIF\x00\x01")), sof, sos), policyFor("jfif:thumbnail"))
+		if testutil.ContainsMarker(got, 0xE0) {
+			t.Fatalf("expected the broken APP0 to be dropped")
+		}
+	})
+
+	t.Run("all keeps no thumbnail with keep=jfif", func(t *testing.T) {
+		p := policyFor("all")
+		p.KeepJFIF = true
+		got := stripBytes(t, testutil.MakeJPEG(jfif, jfxx, sof, sos), p)
+
+		if want := testutil.MakeJPEG(plain, sof, sos); !bytes.Equal(got, want) {
+			t.Fatalf("got %X, want %X", got, want)
+		}
+	})
+
+	t.Run("JFXX is reported", func(t *testing.T) {
+		report, err := Inspect(bytes.NewReader(testutil.MakeJPEG(jfif, jfxx, sof, sos)))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		if got := report.Segments[2].Type; got != KindJFXX {
+			t.Fatalf("segment type %q, want %q", got, KindJFXX)
+		}
+	})
+}
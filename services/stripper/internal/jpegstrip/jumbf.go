@@ -0,0 +1,109 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// APP11 segments carry JUMBF boxes, such as C2PA content credentials, after
+// the "JP" common identifier. A box too large for one segment is split into
+// packets that share a box instance number, each repeating the box header.
+var jumbfPrefix = []byte("JP")
+
+// jumbfPacket is the header of one APP11 JUMBF segment
+type jumbfPacket struct {
+	instance uint16 // En, the same in every packet of a box
+	seq      uint32 // Z, starting at 1
+	label    string // from the description box, only in the first packet
+}
+
+// Label of the C2PA manifest store
+const c2paLabel = "c2pa"
+
+func parseJUMBF(payload []byte) (jumbfPacket, bool) {
+	if !bytes.HasPrefix(payload, jumbfPrefix) || len(payload) < 16 || string(payload[12:16]) != "jumb" {
+		return jumbfPacket{}, false
+	}
+
+	p := jumbfPacket{
+		instance: binary.BigEndian.Uint16(payload[2:]),
+		seq:      binary.BigEndian.Uint32(payload[4:]),
+	}
+	if p.seq == 1 {
+		p.label = jumbfLabel(payload[8:])
+	}
+	return p, true
+}
+
+// Returns the label of a superbox from its description box, or ""
+func jumbfLabel(box []byte) string {
+	b := box[8:]
+	if binary.BigEndian.Uint32(box) == 1 { // 64 bit XLBox
+		if len(b) < 8 {
+			return ""
+		}
+		b = b[8:]
+	}
+
+	// jumd: LBox, TBox, type UUID, toggles, then the label if toggled
+	if len(b) < 25 || string(b[4:8]) != "jumd" || b[24]&0x02 == 0 {
+		return ""
+	}
+	label := b[25:]
+	if end := bytes.IndexByte(label, 0); end >= 0 {
+		return string(label[:end])
+	}
+	return ""
+}
+
+// Labels the JUMBF box instances in the header of an image. Packets may come
+// in any order, so the labels have to be known before any of them is kept.
+func jumbfInstances(data []byte) map[uint16]string {
+	labels := make(map[uint16]string)
+	for _, s := range headerSegments(data) {
+		if packet, ok := parseJUMBF(s.payload); ok && s.marker == 0xEB && packet.label != "" {
+			labels[packet.instance] = packet.label
+		}
+	}
+	return labels
+}
+
+// Reports whether a segment belongs to a JUMBF box whose label the policy
+// drops. labels maps the box instances of the image to their labels, and
+// gains those found while stripping, so that every packet follows the first.
+func (p *Policy) dropsJUMBF(marker byte, payload []byte, labels map[uint16]string) bool {
+	if p == nil || marker != 0xEB || len(p.jumbfLabels) == 0 {
+		return false
+	}
+	packet, ok := parseJUMBF(payload)
+	if !ok {
+		return false
+	}
+	if packet.label != "" {
+		labels[packet.instance] = packet.label
+	}
+	return p.jumbfLabels[labels[packet.instance]]
+}
+
+type jumbfChunk struct {
+	packet  jumbfPacket
+	segment int // index into the report segments
+}
+
+// Numbers the packets of every JUMBF box and labels them all after the first
+func numberJUMBFChunks(segments []SegmentInfo, groups map[uint16][]jumbfChunk) {
+	for _, chunks := range groups {
+		sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].packet.seq < chunks[j].packet.seq })
+		label := chunks[0].packet.label
+		for i, c := range chunks {
+			info := &segments[c.segment]
+			info.Chunk.Seq, info.Chunk.Count, info.Label = i+1, len(chunks), label
+		}
+	}
+}
+
+func jumbfGroup(instance uint16) string {
+	return strconv.Itoa(int(instance))
+}
@@ -0,0 +1,102 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+// helper: build the APP11 segments of a JUMBF superbox with the given label,
+// split into n packets that each repeat the superbox header. The description
+// box fits in the first packet, as writers make sure it does.
+func makeJUMBF(instance uint16, label string, content []byte, n int) [][]byte {
+	box := func(typ string, data []byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+		return append(append(b, typ...), data...)
+	}
+	desc := append(make([]byte, 16), 0x03)
+	desc = append(append(desc, label...), 0)
+	jumd := box("jumd", desc)
+	super := box("jumb", append(jumd, box("json", content)...))
+
+	header, body := super[:8], super[8:]
+	size := max((len(body)+n-1)/n, len(jumd))
+	var segs [][]byte
+	for i := 0; i < n; i++ {
+		part := body[min(i*size, len(body)):min((i+1)*size, len(body))]
+		payload := append([]byte("JP"), binary.BigEndian.AppendUint16(nil, instance)...)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(i+1))
+		payload = append(append(payload, header...), part...)
+		segs = append(segs, testutil.MakeSegment(0xEB, payload))
+	}
+	return segs
+}
+
+func TestJUMBF(t *testing.T) {
+	c2pa := makeJUMBF(1, "c2pa", []byte(`{"creator":"Jane Doe","tool":"Editor 2"}`), 3)
+	other := makeJUMBF(2, "vendor.data", []byte(`{"x":1}`), 1)
+	sos := testutil.MakeSOS([]byte{0x11})
+	img := testutil.MakeJPEG(append(append(append([][]byte{}, c2pa...), other...), sos)...)
+
+	t.Run("Packets are reported as one box", func(t *testing.T) {
+		report, err := Inspect(bytes.NewReader(img))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+
+		want := []struct {
+			group, label string
+			seq, count   int
+		}{{"1", "c2pa", 1, 3}, {"1", "c2pa", 2, 3}, {"1", "c2pa", 3, 3}, {"2", "vendor.data", 1, 1}}
+		for i, w := range want {
+			seg := report.Segments[1+i]
+			if seg.Type != KindJUMBF || seg.Chunk == nil || seg.Label != w.label ||
+				seg.Chunk.Group != w.group || seg.Chunk.Seq != w.seq || seg.Chunk.Count != w.count {
+				t.Fatalf("segment %d: got %s %q %+v, want %+v", 1+i, seg.Type, seg.Label, seg.Chunk, w)
+			}
+		}
+	})
+
+	t.Run("Kept by default", func(t *testing.T) {
+		if got := stripBytes(t, img, policyFor("exif")); !bytes.Equal(got, img) {
+			t.Fatalf("expected JUMBF to be kept")
+		}
+	})
+
+	t.Run("c2pa drops every packet of the manifest store only", func(t *testing.T) {
+		got := stripBytes(t, img, policyFor("c2pa"))
+
+		want := testutil.MakeJPEG(append(append([][]byte{}, other...), sos)...)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %X, want %X", got, want)
+		}
+	})
+
+	t.Run("Packets before the first one follow it", func(t *testing.T) {
+		shuffled := testutil.MakeJPEG(c2pa[2], other[0], c2pa[1], c2pa[0], sos)
+		got := stripBytes(t, shuffled, policyFor("c2pa"))
+
+		want := testutil.MakeJPEG(append(append([][]byte{}, other...), sos)...)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %X, want %X", got, want)
+		}
+	})
+
+	t.Run("jumbf drops every box", func(t *testing.T) {
+		got := stripBytes(t, img, policyFor("jumbf"))
+
+		if testutil.ContainsMarker(got, 0xEB) {
+			t.Fatalf("expected APP11 to be removed")
+		}
+	})
+
+	t.Run("Other APP11 data is left alone", func(t *testing.T) {
+		app11 := testutil.MakeSegment(0xEB, []byte("HDR gain map"))
+		src := testutil.MakeJPEG(app11, sos)
+		if got := stripBytes(t, src, policyFor("c2pa", "jumbf")); !bytes.Equal(got, src) {
+			t.Fatalf("expected non-JUMBF APP11 to be kept")
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package jpegstrip
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrLimitExceeded = errors.New("JPEG exceeds a resource limit")
+
+// Limits bounds the work a single file may cost, against files built to
+// waste CPU and memory. The counts add up over every image in the file,
+// secondary MPF images included. A zero field takes its value from
+// DefaultLimits and a negative one means no limit.
+type Limits struct {
+	Bytes    int64 // size of the input, trailer included
+	Segments int   // segments with a length field, SOS included
+	APPBytes int64 // APPn payload bytes, all segments together
+	Pixels   int64 // width times height of the frame headers together
+	Scans    int   // SOS segments, progressive images have several
+
+	// Width times height of a frame that is decoded, to bake the orientation
+	// or to compare it with the thumbnail. Larger frames are still stripped,
+	// they are only not decoded.
+	DecodePixels int64
+}
+
+// DefaultLimits leaves room for what cameras and editors write: a few dozen
+// segments, some megabytes of metadata and a progressive scan script. Only
+// frames up to the size of a high-end camera's are decoded.
+var DefaultLimits = Limits{
+	Bytes:        64 << 20,
+	Segments:     2000,
+	APPBytes:     8 << 20,
+	Pixels:       256 << 20,
+	Scans:        100,
+	DecodePixels: 48 << 20,
+}
+
+func (p *Policy) limits() Limits {
+	if p == nil {
+		return DefaultLimits
+	}
+	return p.Limits.withDefaults()
+}
+
+// Returns l with its zero fields taken from DefaultLimits
+func (l Limits) withDefaults() Limits {
+	d := DefaultLimits
+	if l.Bytes == 0 {
+		l.Bytes = d.Bytes
+	}
+	if l.Segments == 0 {
+		l.Segments = d.Segments
+	}
+	if l.APPBytes == 0 {
+		l.APPBytes = d.APPBytes
+	}
+	if l.Pixels == 0 {
+		l.Pixels = d.Pixels
+	}
+	if l.Scans == 0 {
+		l.Scans = d.Scans
+	}
+	if l.DecodePixels == 0 {
+		l.DecodePixels = d.DecodePixels
+	}
+	return l
+}
+
+// budget is what is spent of the limits of one request. Every walk over
+// the file draws from the same budget, so a file holding many images costs
+// no more than the limits allow for one.
+type budget struct {
+	Limits
+	segments int
+	appBytes int64
+	scans    int
+	pixels   int64
+}
+
+func newBudget(l Limits) *budget {
+	return &budget{Limits: l}
+}
+
+// Counts a segment against the limits and fails once one is exceeded
+func (b *budget) count(seg segment) error {
+	b.segments++
+	if b.Segments > 0 && b.segments > b.Segments {
+		return &Error{Offset: seg.offset, Marker: seg.marker, Reason: ReasonSegmentLimit}
+	}
+
+	switch {
+	case seg.marker >= 0xE0 && seg.marker <= 0xEF:
+		b.appBytes += int64(len(seg.payload))
+		if b.APPBytes > 0 && b.appBytes > b.APPBytes {
+			return &Error{Offset: seg.offset, Marker: seg.marker, Reason: ReasonAPPLimit}
+		}
+	case seg.marker == 0xDA:
+		b.scans++
+		if b.Scans > 0 && b.scans > b.Scans {
+			return &Error{Offset: seg.offset, Marker: seg.marker, Reason: ReasonScanLimit}
+		}
+	case isFrameMarker(seg.marker):
+		b.pixels += framePixels(seg.payload)
+		if b.Pixels > 0 && b.pixels > b.Pixels {
+			return &Error{Offset: seg.offset, Marker: seg.marker, Reason: ReasonPixelLimit}
+		}
+	}
+	return nil
+}
+
+// Reads all of in, failing once it is longer than the limit allows
+func readLimited(in io.Reader, l Limits) ([]byte, error) {
+	if l.Bytes >= 0 {
+		in = io.LimitReader(in, l.Bytes+1)
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, &Error{Offset: -1, Reason: ReasonRead, Err: err}
+	}
+	if l.Bytes >= 0 && int64(len(data)) > l.Bytes {
+		return nil, &Error{Offset: l.Bytes, Reason: ReasonSizeLimit}
+	}
+	return data, nil
+}
+
+// Returns width times height of a frame header
+func framePixels(sof []byte) int64 {
+	if len(sof) < 5 {
+		return 0
+	}
+	height := int64(binary.BigEndian.Uint16(sof[1:]))
+	width := int64(binary.BigEndian.Uint16(sof[3:]))
+	return width * height
+}
+
+// Reports whether a frame header has more pixels than allowed
+func (l Limits) tooManyPixels(sof []byte) bool {
+	return l.Pixels > 0 && framePixels(sof) > l.Pixels
+}
+
+// Reports whether a frame is worth decoding from a file of the given size.
+// Every block takes two bits at least, so a small file can't code a big frame.
+func (l Limits) decodable(width, height, size int) bool {
+	pixels := int64(width) * int64(height)
+	if l.DecodePixels > 0 && pixels > l.DecodePixels {
+		return false
+	}
+	return pixels <= 64*4*int64(size)
+}
@@ -0,0 +1,145 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestLimits(t *testing.T) {
+	sof := func(w, h uint16) []byte {
+		return testutil.MakeSegment(0xC0, []byte{8, byte(h >> 8), byte(h), byte(w >> 8), byte(w), 1, 1, 0x11, 0})
+	}
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+
+	strip := func(img []byte, l Limits) error {
+		p := NewPolicy()
+		p.Limits = l
+		return Strip(bytes.NewReader(img), &bytes.Buffer{}, p)
+	}
+	expect := func(t *testing.T, err error, reason Reason) {
+		t.Helper()
+		var e *Error
+		if !errors.Is(err, ErrLimitExceeded) || !errors.As(err, &e) || e.Reason != reason {
+			t.Fatalf("expected %s, got %v", reason, err)
+		}
+	}
+
+	t.Run("Segment count", func(t *testing.T) {
+		var segs [][]byte
+		for range 10 {
+			segs = append(segs, testutil.MakeSegment(0xFE, []byte("x")))
+		}
+		img := testutil.MakeJPEG(append(segs, sos)...)
+
+		expect(t, strip(img, Limits{Segments: 10}), ReasonSegmentLimit)
+		if err := strip(img, Limits{Segments: 11}); err != nil {
+			t.Fatalf("unexpected error at the limit: %v", err)
+		}
+	})
+
+	t.Run("APP bytes add up over segments", func(t *testing.T) {
+		app := testutil.MakeSegment(0xEC, make([]byte, 600))
+		img := testutil.MakeJPEG(app, app, sos)
+
+		expect(t, strip(img, Limits{APPBytes: 1000}), ReasonAPPLimit)
+		if err := strip(img, Limits{APPBytes: 1200}); err != nil {
+			t.Fatalf("unexpected error at the limit: %v", err)
+		}
+	})
+
+	t.Run("Frame size", func(t *testing.T) {
+		img := testutil.MakeJPEG(sof(65535, 65535), sos)
+
+		err := strip(img, DefaultLimits)
+		expect(t, err, ReasonPixelLimit)
+		if e := err.(*Error); e.Offset != 2 || e.Marker != 0xC0 {
+			t.Fatalf("unexpected position %+v", e)
+		}
+		if err := strip(img, Limits{Pixels: -1}); err != nil {
+			t.Fatalf("negative limit: %v", err)
+		}
+	})
+
+	t.Run("Zero limits are the defaults", func(t *testing.T) {
+		img := testutil.MakeJPEG(sof(65535, 65535), sos)
+
+		expect(t, strip(img, Limits{}), ReasonPixelLimit)
+		expect(t, Strip(bytes.NewReader(img), &bytes.Buffer{}, &Policy{}), ReasonPixelLimit)
+		if got := (Limits{Scans: 3}).withDefaults(); got.Scans != 3 || got.Segments != DefaultLimits.Segments {
+			t.Fatalf("unexpected %+v", got)
+		}
+	})
+
+	t.Run("Frames over the decode size keep their orientation", func(t *testing.T) {
+		src := withOrientation(makeCodedJPEG(t, 48, 32, false), 6)
+
+		p := NewPolicy()
+		p.Orientation = OrientationBake
+		p.Limits = Limits{DecodePixels: 48*32 - 1}
+		if got := stripBytes(t, src, p); !bytes.Equal(got, src) {
+			t.Fatalf("expected the image to be kept as it is")
+		}
+
+		p.Limits = Limits{DecodePixels: 48 * 32}
+		if got := stripBytes(t, src, p); bytes.Equal(got, src) {
+			t.Fatalf("expected the image to be baked at the limit")
+		}
+	})
+
+	t.Run("Frame size is checked before baking the orientation", func(t *testing.T) {
+		exif := testutil.Exif{IFD0: []testutil.Tag{testutil.Short(0x0112, 6)}}
+		img := testutil.MakeJPEG(testutil.MakeSegment(0xE1, exif.Payload()), sof(65535, 65535), sos)
+
+		p := NewPolicy()
+		p.Orientation = OrientationBake
+		err := Strip(bytes.NewReader(img), &bytes.Buffer{}, p)
+		expect(t, err, ReasonPixelLimit)
+	})
+
+	t.Run("Scan count", func(t *testing.T) {
+		img := testutil.MakeJPEG(sof(8, 8), sos, sos, sos)
+
+		expect(t, strip(img, Limits{Scans: 2}), ReasonScanLimit)
+		if err := strip(img, Limits{Scans: 3}); err != nil {
+			t.Fatalf("unexpected error at the limit: %v", err)
+		}
+	})
+
+	t.Run("Input size", func(t *testing.T) {
+		img := testutil.MakeJPEG(testutil.MakeSegment(0xFE, make([]byte, 100)), sos)
+
+		err := strip(img, Limits{Bytes: int64(len(img) - 1)})
+		expect(t, err, ReasonSizeLimit)
+		if err := strip(img, Limits{Bytes: int64(len(img))}); err != nil {
+			t.Fatalf("unexpected error at the limit: %v", err)
+		}
+	})
+
+	t.Run("Secondary images share the limits", func(t *testing.T) {
+		secondary := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x33}))
+		img := makeMPFImage(nil, secondary, secondary)
+
+		expect(t, strip(img, Limits{Scans: 2}), ReasonScanLimit)
+		// The MPF index is looked up without charging the primary image twice
+		if err := strip(img, Limits{Scans: 3}); err != nil {
+			t.Fatalf("unexpected error at the limit: %v", err)
+		}
+	})
+
+	t.Run("Inspect uses the default limits", func(t *testing.T) {
+		_, err := Inspect(bytes.NewReader(testutil.MakeJPEG(sof(65535, 65535), sos)))
+		expect(t, err, ReasonPixelLimit)
+	})
+
+	t.Run("Inspect takes its limits", func(t *testing.T) {
+		img := testutil.MakeJPEG(sof(8, 8), sos, sos, sos)
+
+		_, err := InspectMode(bytes.NewReader(img), ParseDefault, Limits{Scans: 2})
+		expect(t, err, ReasonScanLimit)
+		_, err = InspectMode(bytes.NewReader(img), ParseDefault, Limits{Bytes: int64(len(img) - 1)})
+		expect(t, err, ReasonSizeLimit)
+	})
+}
@@ -0,0 +1,235 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// SecondaryMode decides what happens to the images an MPF index lists after
+// the primary image, such as depth maps, HDR gain maps and large previews
+type SecondaryMode int
+
+const (
+	// SecondaryKeep cleans every secondary image with the same policy and
+	// rewrites the MPF index so it still finds them
+	SecondaryKeep SecondaryMode = iota
+	// SecondaryDrop removes the secondary images along with the MPF index
+	SecondaryDrop
+)
+
+const tagMPEntry = 0xB002
+
+// mpImage is a secondary image listed in the MPF index of the primary image
+type mpImage struct {
+	entry int // index into the MP entry list
+	start int // position in the input
+	size  int
+}
+
+// mpIndex is the MP entry list found in the APP2 MPF segment of the primary
+// image. Offsets in it are relative to the TIFF header of that segment.
+type mpIndex struct {
+	end    int // end of the primary image, just past its EOI
+	images []mpImage
+}
+
+// Looks for an MPF index in the primary image and checks that every image it
+// lists lies after the primary EOI. It reports false when there is nothing
+// to rewrite, leaving any damage for Strip to report. The walk is held to
+// what is left of the budget, but not charged, as the primary image is
+// counted again when it is stripped.
+func parseMPF(data []byte, b *budget) (*mpIndex, bool) {
+	spent := *b
+	defer func() { *b = spent }()
+
+	sr := newSegmentReader(bytes.NewReader(data))
+	sr.budget = b
+	if sr.readSOI() != nil {
+		return nil, false
+	}
+
+	var mpf *segment
+	for {
+		seg, err := sr.next()
+		if err != nil {
+			return nil, false
+		}
+		if seg.marker == 0xDA && sr.copyEntropy(io.Discard) != nil {
+			return nil, false
+		}
+		if mpf == nil && seg.marker == 0xE2 && bytes.HasPrefix(seg.payload, mpfPrefix) {
+			mpf = &seg
+		}
+		if seg.marker == 0xD9 {
+			break
+		}
+	}
+	if mpf == nil {
+		return nil, false
+	}
+
+	t, err := parseTIFF(mpf.payload[len(mpfPrefix):])
+	if err != nil {
+		return nil, false
+	}
+	e := t.ifd0.find(tagMPEntry)
+	if e == nil || e.typ != typeUndefined || len(e.value)%16 != 0 {
+		return nil, false
+	}
+
+	mp := &mpIndex{end: int(sr.off)}
+	base := int(mpf.offset) + 4 + len(mpfPrefix) // FF E2, length, "MPF\0"
+	for i := 1; i < len(e.value)/16; i++ {
+		size := int(t.order.Uint32(e.value[16*i+4:]))
+		offset := int(t.order.Uint32(e.value[16*i+8:]))
+		if size == 0 && offset == 0 {
+			continue // listed but not stored in this file
+		}
+
+		start := base + offset
+		if start < mp.end || size > len(data)-start {
+			return nil, false
+		}
+		mp.images = append(mp.images, mpImage{entry: i, start: start, size: size})
+	}
+	if len(mp.images) == 0 {
+		return nil, false
+	}
+
+	sort.Slice(mp.images, func(i, j int) bool { return mp.images[i].start < mp.images[j].start })
+	for i := 1; i < len(mp.images); i++ {
+		if prev := mp.images[i-1]; prev.start+prev.size > mp.images[i].start {
+			return nil, false
+		}
+	}
+	return mp, true
+}
+
+// Strips the primary image and every secondary image separately and puts
+// them back together, pointing the MPF index at the new positions. All of
+// them draw from the same budget.
+func stripMultiPicture(data []byte, mp *mpIndex, out io.Writer, policy *Policy, b *budget) ([]Repair, error) {
+	p := policy.clone()
+	last := mp.images[len(mp.images)-1]
+	rest := data[last.start+last.size:]
+
+	// The primary and secondary images are stripped on their own, so
+	// none of them has a trailer
+	primary := p.clone()
+	primary.Trailer = TrailerDrop
+	if p.Secondary == SecondaryDrop {
+		primary.Add(Rule{Marker: 0xE2, Prefix: mpfPrefix})
+	} else {
+		// Kept images are useless without the index, even in allowlist mode
+		primary.keepMPF = true
+		if primary.Orientation == OrientationBake {
+			// Depth and gain maps have to stay aligned with the primary pixels
+			primary.Orientation = OrientationKeep
+		}
+	}
+
+	var buf bytes.Buffer
+	repairs, err := stripImage(data[:mp.end], &buf, primary, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Secondary == SecondaryKeep {
+		primarySize := buf.Len()
+		positions := make(map[int][2]int)
+		pos := mp.end
+		for _, img := range mp.images {
+			// Nothing points at the bytes between images, so they go
+			if img.start > pos {
+				repairs = append(repairs, Repair{Offset: int64(pos), Kind: RepairSkippedBytes, Length: int64(img.start - pos)})
+			}
+			pos = img.start + img.size
+
+			start := buf.Len()
+			fixed, err := stripImage(data[img.start:img.start+img.size], &buf, primary, b)
+			if err != nil {
+				return nil, shiftError(err, int64(img.start))
+			}
+			for _, r := range fixed {
+				r.Offset += int64(img.start)
+				repairs = append(repairs, r)
+			}
+			positions[img.entry] = [2]int{start, buf.Len() - start}
+		}
+		rewriteMPF(buf.Bytes(), primarySize, positions)
+	}
+
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		return nil, &Error{Offset: -1, Reason: ReasonWrite, Err: err}
+	}
+	if p.Trailer == TrailerDrop {
+		return repairs, nil
+	}
+	if _, err := out.Write(rest); err != nil {
+		return nil, &Error{Offset: int64(len(data) - len(rest)), Reason: ReasonWrite, Err: err}
+	}
+	return repairs, nil
+}
+
+// Points the MP entries of the first MPF segment at the new image positions,
+// given as start and size per entry
+func rewriteMPF(data []byte, primarySize int, positions map[int][2]int) {
+	sr := newSegmentReader(bytes.NewReader(data))
+	if sr.readSOI() != nil {
+		return
+	}
+
+	for {
+		seg, err := sr.next()
+		if err != nil || seg.marker == 0xD9 {
+			return // the policy removed the index
+		}
+		if seg.marker == 0xDA && sr.copyEntropy(io.Discard) != nil {
+			return
+		}
+		if seg.marker != 0xE2 || !bytes.HasPrefix(seg.payload, mpfPrefix) {
+			continue
+		}
+
+		base := int(seg.offset) + 4 + len(mpfPrefix)
+		tiff := data[base : int(seg.offset)+seg.size()]
+		t, err := parseTIFF(tiff)
+		if err != nil {
+			return
+		}
+		e := t.ifd0.find(tagMPEntry)
+		if e == nil || e.typ != typeUndefined || len(e.value)%16 != 0 {
+			return
+		}
+
+		entries := tiff[e.offset : int(e.offset)+len(e.value)]
+		t.order.PutUint32(entries[4:], uint32(primarySize))
+		for i, pos := range positions {
+			t.order.PutUint32(entries[16*i+4:], uint32(pos[1]))
+			t.order.PutUint32(entries[16*i+8:], uint32(pos[0]-base))
+		}
+		return
+	}
+}
+
+// Returns a copy of the policy that can be changed without touching p. A nil
+// policy gives an empty one.
+func (p *Policy) clone() *Policy {
+	if p == nil {
+		return NewPolicy()
+	}
+
+	c := *p
+	c.rules = maps.Clone(p.rules)
+	for marker, r := range c.rules {
+		c.rules[marker] = slices.Clone(r)
+	}
+	c.resources = maps.Clone(p.resources)
+	c.exifTags = maps.Clone(p.exifTags)
+	c.xmpProps = maps.Clone(p.xmpProps)
+	c.jumbfLabels = maps.Clone(p.jumbfLabels)
+	return &c
+}
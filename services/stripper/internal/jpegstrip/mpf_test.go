@@ -0,0 +1,195 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+// helper: build an MPF file from a primary image, whose segments go in front
+// of the MPF index, and secondary images appended after its EOI
+func makeMPFImage(primary [][]byte, secondaries ...[]byte) []byte {
+	build := func(entries []byte) []byte {
+		mpf := testutil.Exif{IFD0: []testutil.Tag{
+			testutil.Undefined(0xB000, []byte("0100")),
+			testutil.Long(0xB001, uint32(len(secondaries)+1)),
+			testutil.Undefined(0xB002, entries),
+		}}.TIFF()
+		segs := append(append([][]byte{}, primary...), testutil.MakeSegment(0xE2, append([]byte("MPF\x00"), mpf...)))
+		segs = append(segs, testutil.MakeSOS([]byte{0x11, 0x22}))
+		return testutil.MakeJPEG(segs...)
+	}
+
+	// The index has the same size whatever it holds, so lay out once with
+	// zero entries and then fill them in
+	entries := make([]byte, 16*(len(secondaries)+1))
+	img := build(entries)
+	base := bytes.Index(img, []byte("MPF\x00")) + 4
+
+	pos := len(img)
+	binary.BigEndian.PutUint32(entries[4:], uint32(len(img)))
+	for i, s := range secondaries {
+		binary.BigEndian.PutUint32(entries[16*(i+1)+4:], uint32(len(s)))
+		binary.BigEndian.PutUint32(entries[16*(i+1)+8:], uint32(pos-base))
+		pos += len(s)
+	}
+
+	img = build(entries)
+	for _, s := range secondaries {
+		img = append(img, s...)
+	}
+	return img
+}
+
+// Returns the secondary images an MPF file points at, after checking each
+// one starts with SOI
+func mpfImages(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+
+	mp, ok := parseMPF(data, newBudget(DefaultLimits))
+	if !ok {
+		t.Fatalf("no valid MPF index in output")
+	}
+
+	var images [][]byte
+	for _, img := range mp.images {
+		b := data[img.start : img.start+img.size]
+		if !bytes.HasPrefix(b, []byte{0xFF, 0xD8}) {
+			t.Fatalf("MPF entry %d does not point at an image", img.entry)
+		}
+		images = append(images, b)
+	}
+	return images
+}
+
+func TestStripMPF(t *testing.T) {
+	exif := testutil.MakeSegment(0xE1, testutil.Exif{IFD0: []testutil.Tag{
+		testutil.ASCII(0x010F, "ACME"),
+		testutil.Short(0x0112, 6),
+	}}.Payload())
+	com := testutil.MakeSegment(0xFE, []byte("a long comment that changes the offsets"))
+	depth := testutil.MakeJPEG(exif, testutil.MakeSegment(0xE2, []byte("MPF\x00MM\x00\x2A\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00")), testutil.MakeSOS([]byte{0x33}))
+	gain := testutil.MakeJPEG(exif, com, testutil.MakeSOS([]byte{0x44}))
+	src := makeMPFImage([][]byte{exif, com}, depth, gain)
+
+	t.Run("Secondary images are cleaned and still found", func(t *testing.T) {
+		got := stripBytes(t, src, policyFor("exif", "comment"))
+
+		if bytes.Contains(got, []byte("ACME")) {
+			t.Fatalf("EXIF left in a secondary image")
+		}
+		images := mpfImages(t, got)
+		if len(images) != 2 {
+			t.Fatalf("expected 2 secondary images, got %d", len(images))
+		}
+		if want := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x44})); !bytes.Equal(images[1], want) {
+			t.Fatalf("unexpected gain map %X", images[1])
+		}
+
+		if !bytes.HasSuffix(got, images[1]) {
+			t.Fatalf("unexpected bytes after the last image")
+		}
+	})
+
+	t.Run("Primary size is rewritten", func(t *testing.T) {
+		got := stripBytes(t, src, policyFor("comment"))
+
+		mp, _ := parseMPF(got, newBudget(DefaultLimits))
+		tiff, _ := parseTIFF(got[bytes.Index(got, []byte("MPF\x00"))+4:])
+		entries := tiff.ifd0.find(tagMPEntry).value
+		if size := int(binary.BigEndian.Uint32(entries[4:])); size != mp.end {
+			t.Fatalf("primary size %d, want %d", size, mp.end)
+		}
+	})
+
+	t.Run("Secondary images can be dropped", func(t *testing.T) {
+		got := stripBytes(t, src, policyFor("mpf:images"))
+
+		want := testutil.MakeJPEG(exif, com, testutil.MakeSOS([]byte{0x11, 0x22}))
+		if !bytes.Equal(got, want) {
+			t.Fatalf("expected the primary image without its MPF index")
+		}
+	})
+
+	t.Run("Other trailing data follows the trailer rule", func(t *testing.T) {
+		withZip := append(append([]byte{}, src...), "PK\x03\x04"...)
+
+		if got := stripBytes(t, withZip, NewPolicy()); !bytes.HasSuffix(got, []byte("PK\x03\x04")) {
+			t.Fatalf("expected trailing data to be kept")
+		}
+
+		got := stripBytes(t, withZip, policyFor("trailer"))
+		if bytes.Contains(got, []byte("PK\x03\x04")) {
+			t.Fatalf("expected trailing data to be dropped")
+		}
+		if len(mpfImages(t, got)) != 2 {
+			t.Fatalf("expected secondary images to be kept")
+		}
+	})
+
+	t.Run("Baking falls back to the tag to keep images aligned", func(t *testing.T) {
+		p := policyFor("exif")
+		p.Orientation = OrientationBake
+		got := stripBytes(t, src, p)
+
+		if !bytes.Contains(got, orientationExif(6)) {
+			t.Fatalf("expected minimal orientation EXIF")
+		}
+		if len(mpfImages(t, got)) != 2 {
+			t.Fatalf("expected secondary images to be kept")
+		}
+	})
+
+	t.Run("Allowlist keeps the index for kept images", func(t *testing.T) {
+		p := NewPolicy()
+		p.Allowlist = true
+		got := stripBytes(t, src, p)
+
+		if bytes.Contains(got, []byte("ACME")) || bytes.Contains(got, []byte("a long comment")) {
+			t.Fatalf("expected allowlist mode to remove EXIF and comments")
+		}
+		if len(mpfImages(t, got)) != 2 {
+			t.Fatalf("expected secondary images to be kept")
+		}
+
+		if got := stripBytes(t, src, policyFor("all")); testutil.ContainsMarker(got, 0xE2) || !bytes.HasSuffix(got, []byte{0xFF, 0xD9}) {
+			t.Fatalf("expected the primary image alone")
+		}
+	})
+
+	t.Run("Bytes between images are reported", func(t *testing.T) {
+		mp, _ := parseMPF(src, newBudget(DefaultLimits))
+		gapped := append(append(append([]byte{}, src[:mp.end]...), "JUNK"...), src[mp.end:]...)
+		base := bytes.Index(gapped, []byte("MPF\x00")) + 4
+		tiff, _ := parseTIFF(gapped[base:])
+		entries := gapped[base+int(tiff.ifd0.find(tagMPEntry).offset):]
+		for i := 1; i <= 2; i++ {
+			binary.BigEndian.PutUint32(entries[16*i+8:], binary.BigEndian.Uint32(entries[16*i+8:])+4)
+		}
+
+		var out bytes.Buffer
+		repairs, err := StripWithRepairs(bytes.NewReader(gapped), &out, NewPolicy())
+		if err != nil {
+			t.Fatalf("StripWithRepairs: %v", err)
+		}
+		want := Repair{Offset: int64(mp.end), Kind: RepairSkippedBytes, Length: 4}
+		if len(repairs) != 1 || repairs[0] != want {
+			t.Fatalf("repairs = %+v, want %+v", repairs, want)
+		}
+		if bytes.Contains(out.Bytes(), []byte("JUNK")) || len(mpfImages(t, out.Bytes())) != 2 {
+			t.Fatalf("expected the gap to go and the images to be found")
+		}
+	})
+
+	t.Run("Broken index leaves the trailer alone", func(t *testing.T) {
+		broken := append([]byte{}, src...)
+		broken = broken[:len(broken)-len(gain)/2]
+
+		got := stripBytes(t, broken, policyFor("comment"))
+		if !bytes.HasSuffix(got, broken[len(broken)-10:]) {
+			t.Fatalf("expected trailing bytes to be copied")
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// OrientationMode decides how the EXIF Orientation tag survives stripping
+type OrientationMode int
+
+const (
+	// OrientationDrop lets the tag go along with its EXIF segment
+	OrientationDrop OrientationMode = iota
+	// OrientationKeep writes a minimal EXIF segment holding only the tag
+	// when the EXIF segment is removed
+	OrientationKeep
+	// OrientationBake rotates the DCT blocks losslessly so the pixels are
+	// upright and no tag is needed. Images that cannot be transformed, such
+	// as progressive JPEGs or ones whose flipped edges end in partial MCUs,
+	// fall back to OrientationKeep.
+	OrientationBake
+)
+
+const (
+	tagOrientation     = 0x0112
+	tagPixelXDimension = 0xA002
+	tagPixelYDimension = 0xA003
+)
+
+// Returns the Orientation tag of an APP1 EXIF payload, or 0 when it has none
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, exifPrefix) {
+		return 0
+	}
+	t, err := parseTIFF(payload[len(exifPrefix):])
+	if err != nil {
+		return 0
+	}
+	e := t.ifd0.find(tagOrientation)
+	if e == nil || e.typ != typeShort {
+		return 0
+	}
+	if o := int(t.order.Uint16(e.value)); o >= 1 && o <= 8 {
+		return o
+	}
+	return 0
+}
+
+// Builds an APP1 EXIF payload that holds nothing but the Orientation tag
+func orientationExif(orientation int) []byte {
+	b := append([]byte{}, exifPrefix...)
+	b = append(b, 'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, tagOrientation)
+	b = binary.BigEndian.AppendUint16(b, typeShort)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(orientation))
+	b = append(b, 0x00, 0x00)
+	return binary.BigEndian.AppendUint32(b, 0) // no IFD1
+}
+
+// Rotates the image upright when its EXIF Orientation asks for it. It
+// reports false when the image needed rotating but could not be transformed,
+// in which case the original bytes are returned. Frames over the pixel limit
+// are not decoded and left for Strip to reject.
+func bakeOrientation(data []byte, limits Limits) ([]byte, bool) {
+	orientation := 0
+	for _, s := range headerSegments(data) {
+		if s.marker == 0xE1 && bytes.HasPrefix(s.payload, exifPrefix) {
+			orientation = exifOrientation(s.payload)
+			break
+		}
+	}
+	if orientation <= 1 {
+		return data, true
+	}
+	for _, s := range headerSegments(data) {
+		if isFrameMarker(s.marker) && limits.tooManyPixels(s.payload) {
+			return data, false
+		}
+	}
+
+	img, err := decodeCoefficients(data, limits)
+	if err == nil {
+		err = img.transform(orientationTransforms[orientation])
+	}
+	if err != nil {
+		return data, false
+	}
+
+	for _, s := range img.extra {
+		if s.marker == 0xE1 && bytes.HasPrefix(s.payload, exifPrefix) {
+			resetOrientation(s.payload[len(exifPrefix):], img.width, img.height)
+		}
+	}
+
+	return img.encode(), true
+}
+
+// Sets the Orientation tag to 1 in place and records the new pixel
+// dimensions in the Exif IFD
+func resetOrientation(tiff []byte, width, height int) {
+	t, err := parseTIFF(tiff)
+	if err != nil {
+		return
+	}
+
+	if e := t.ifd0.find(tagOrientation); e != nil && e.typ == typeShort {
+		t.order.PutUint16(tiff[e.pos+8:], 1)
+	}
+
+	for tag, v := range map[uint16]int{tagPixelXDimension: width, tagPixelYDimension: height} {
+		e := t.ifd(ExifIFD).find(tag)
+		switch {
+		case e == nil || e.count != 1:
+		case e.typ == typeShort && v <= 0xFFFF:
+			t.order.PutUint16(tiff[e.pos+8:], uint16(v))
+		case e.typ == typeLong:
+			t.order.PutUint32(tiff[e.pos+8:], uint32(v))
+		}
+	}
+}
+
+// Returns the segments in front of the first scan. It stops quietly at the
+// first sign of damage, leaving error reporting to Strip.
+func headerSegments(data []byte) []rawSegment {
+	var segments []rawSegment
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 || isNoLengthMarker(marker) {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segments = append(segments, rawSegment{marker, data[pos+4 : pos+2+length]})
+		pos += 2 + length
+	}
+	return segments
+}
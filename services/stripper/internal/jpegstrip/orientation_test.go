@@ -0,0 +1,296 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+// helper: encode a colourful test picture with the standard library
+func makeCodedJPEG(t *testing.T, w, h int, gray bool) []byte {
+	t.Helper()
+
+	var img image.Image
+	if gray {
+		g := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				g.SetGray(x, y, color.Gray{Y: uint8(x*5 + y*3)})
+			}
+		}
+		img = g
+	} else {
+		rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				rgba.Set(x, y, color.RGBA{R: uint8(x * 5), G: uint8(y * 7), B: uint8((x ^ y) * 3), A: 0xFF})
+			}
+		}
+		img = rgba
+	}
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	return b.Bytes()
+}
+
+// helper: put an EXIF segment with the given orientation right after SOI
+func withOrientation(data []byte, orientation uint16) []byte {
+	exif := testutil.Exif{IFD0: []testutil.Tag{testutil.Short(0x0112, orientation)}}
+	seg := testutil.MakeSegment(0xE1, exif.Payload())
+	return append(append(append([]byte{}, data[:2]...), seg...), data[2:]...)
+}
+
+func decodeJPEG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("jpeg.Decode: %v", err)
+	}
+	return img
+}
+
+// Compares got against want displayed with the given EXIF orientation
+func assertOriented(t *testing.T, want, got image.Image, orientation int) {
+	t.Helper()
+
+	wb, gb := want.Bounds(), got.Bounds()
+	transposed := orientation >= 5
+	ww, wh := wb.Dx(), wb.Dy()
+	if transposed {
+		ww, wh = wh, ww
+	}
+	if gb.Dx() > ww || gb.Dy() > wh {
+		t.Fatalf("output is %dx%d, want at most %dx%d", gb.Dx(), gb.Dy(), ww, wh)
+	}
+
+	tr := orientationTransforms[orientation]
+	worst := 0
+	for y := 0; y < gb.Dy(); y++ {
+		for x := 0; x < gb.Dx(); x++ {
+			sx, sy := x, y
+			if tr.flipH {
+				sx = gb.Dx() - 1 - x
+			}
+			if tr.flipV {
+				sy = gb.Dy() - 1 - y
+			}
+			if tr.transpose {
+				sx, sy = sy, sx
+			}
+
+			g := color.GrayModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y)).(color.Gray).Y
+			w := color.GrayModel.Convert(want.At(wb.Min.X+sx, wb.Min.Y+sy)).(color.Gray).Y
+			worst = max(worst, int(g)-int(w), int(w)-int(g))
+		}
+	}
+
+	// The IDCT is not exactly symmetric, so allow rounding noise
+	if worst > 3 {
+		t.Fatalf("orientation %d: pixels differ by up to %d", orientation, worst)
+	}
+}
+
+func TestCoefficientRoundTrip(t *testing.T) {
+	for _, gray := range []bool{false, true} {
+		src := makeCodedJPEG(t, 45, 29, gray)
+
+		img, err := decodeCoefficients(src, DefaultLimits)
+		if err != nil {
+			t.Fatalf("decodeCoefficients: %v", err)
+		}
+		out := img.encode()
+
+		want, got := decodeJPEG(t, src), decodeJPEG(t, out)
+		if want.Bounds() != got.Bounds() {
+			t.Fatalf("bounds changed from %v to %v", want.Bounds(), got.Bounds())
+		}
+		for y := 0; y < want.Bounds().Dy(); y++ {
+			for x := 0; x < want.Bounds().Dx(); x++ {
+				if want.At(x, y) != got.At(x, y) {
+					t.Fatalf("gray=%v: pixel (%d,%d) changed after re-encoding", gray, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestBakeOrientation(t *testing.T) {
+	for orientation := 2; orientation <= 8; orientation++ {
+		src := withOrientation(makeCodedJPEG(t, 48, 32, false), uint16(orientation))
+
+		p := NewPolicy()
+		p.Orientation = OrientationBake
+		got := stripBytes(t, src, p)
+
+		assertOriented(t, decodeJPEG(t, src), decodeJPEG(t, got), orientation)
+
+		for _, s := range headerSegments(got) {
+			if s.marker == 0xE1 && exifOrientation(s.payload) != 1 {
+				t.Fatalf("orientation %d: tag not reset to 1", orientation)
+			}
+		}
+	}
+
+	t.Run("Partial MCUs on a flipped edge fall back to the tag", func(t *testing.T) {
+		for orientation := 2; orientation <= 8; orientation++ {
+			src := withOrientation(makeCodedJPEG(t, 50, 37, false), uint16(orientation))
+
+			p := NewPolicy()
+			p.Orientation = OrientationBake
+			got := stripBytes(t, src, p)
+
+			// A plain transpose moves whole blocks and needs no trimming
+			if orientation == 5 {
+				assertOriented(t, decodeJPEG(t, src), decodeJPEG(t, got), orientation)
+				if b := decodeJPEG(t, got).Bounds(); b.Dx() != 37 || b.Dy() != 50 {
+					t.Fatalf("expected 37x50 output, got %v", b)
+				}
+				continue
+			}
+			if !bytes.Equal(got, src) {
+				t.Fatalf("orientation %d: expected the image to be kept as it is", orientation)
+			}
+		}
+	})
+
+	t.Run("Grayscale", func(t *testing.T) {
+		src := withOrientation(makeCodedJPEG(t, 40, 24, true), 6)
+
+		p := NewPolicy()
+		p.Orientation = OrientationBake
+		got := stripBytes(t, src, p)
+
+		assertOriented(t, decodeJPEG(t, src), decodeJPEG(t, got), 6)
+	})
+
+	t.Run("Baked image without EXIF needs no tag", func(t *testing.T) {
+		src := withOrientation(makeCodedJPEG(t, 32, 16, false), 8)
+
+		p := policyFor("exif")
+		p.Orientation = OrientationBake
+		got := stripBytes(t, src, p)
+
+		if bytes.Contains(got, exifPrefix) {
+			t.Fatalf("expected no EXIF segment after baking")
+		}
+		if b := decodeJPEG(t, got).Bounds(); b.Dx() != 16 || b.Dy() != 32 {
+			t.Fatalf("expected 16x32 output, got %v", b)
+		}
+	})
+
+	t.Run("Upright image is left alone", func(t *testing.T) {
+		src := withOrientation(makeCodedJPEG(t, 32, 16, false), 1)
+
+		p := NewPolicy()
+		p.Orientation = OrientationBake
+		if got := stripBytes(t, src, p); !bytes.Equal(got, src) {
+			t.Fatalf("expected image to be unchanged")
+		}
+	})
+
+	t.Run("Frame too big for the file falls back to the tag", func(t *testing.T) {
+		for _, size := range []uint16{16000, 6000} {
+			src := withOrientation(makeCodedJPEG(t, 16, 16, false), 6)
+			sof := bytes.Index(src, []byte{0xFF, 0xC0})
+			binary.BigEndian.PutUint16(src[sof+5:], size)
+			binary.BigEndian.PutUint16(src[sof+7:], size)
+
+			p := NewPolicy()
+			p.Orientation = OrientationBake
+			got := stripBytes(t, src, p)
+
+			if !bytes.Equal(got, src) {
+				t.Fatalf("%d: expected the image to be kept as it is", size)
+			}
+		}
+	})
+
+	t.Run("Truncated scan falls back to the tag", func(t *testing.T) {
+		full := withOrientation(makeCodedJPEG(t, 48, 32, false), 6)
+		sos := bytes.Index(full, []byte{0xFF, 0xDA})
+		start := sos + 2 + int(binary.BigEndian.Uint16(full[sos+2:]))
+		cut := start + (len(full)-start)/2
+		src := append(full[:cut:cut], 0xFF, 0xD9)
+
+		if _, err := decodeCoefficients(src, DefaultLimits); !errors.Is(err, ErrTruncated) {
+			t.Fatalf("expected ErrTruncated, got %v", err)
+		}
+
+		p := NewPolicy()
+		p.Orientation = OrientationBake
+		if got := stripBytes(t, src, p); !bytes.Equal(got, src) {
+			t.Fatalf("expected the image to be kept as it is")
+		}
+	})
+
+	t.Run("Progressive image falls back to the tag", func(t *testing.T) {
+		exif := testutil.MakeSegment(0xE1, testutil.Exif{IFD0: []testutil.Tag{
+			testutil.ASCII(0x010F, "ACME"),
+			testutil.Short(0x0112, 6),
+		}}.Payload())
+		sof2 := testutil.MakeSegment(0xC2, []byte{8, 0, 16, 0, 16, 1, 1, 0x11, 0})
+		src := testutil.MakeJPEG(exif, sof2, testutil.MakeSOS([]byte{0x11, 0x22}))
+
+		p := policyFor("exif")
+		p.Orientation = OrientationBake
+		got := stripBytes(t, src, p)
+
+		if !bytes.Contains(got, orientationExif(6)) {
+			t.Fatalf("expected minimal orientation EXIF in fallback")
+		}
+		if bytes.Contains(got, []byte("ACME")) {
+			t.Fatalf("expected original EXIF to be removed")
+		}
+	})
+}
+
+func TestKeepOrientation(t *testing.T) {
+	exif := testutil.MakeSegment(0xE1, testutil.Exif{IFD0: []testutil.Tag{
+		testutil.ASCII(0x010F, "ACME"),
+		testutil.Short(0x0112, 8),
+	}}.Payload())
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+
+	t.Run("Minimal EXIF replaces the removed segment", func(t *testing.T) {
+		p := policyFor("exif")
+		p.Orientation = OrientationKeep
+		got := stripBytes(t, testutil.MakeJPEG(exif, sos), p)
+
+		if bytes.Contains(got, []byte("ACME")) {
+			t.Fatalf("EXIF not removed")
+		}
+		segments := headerSegments(got)
+		if len(segments) != 1 || exifOrientation(segments[0].payload) != 8 {
+			t.Fatalf("expected a single EXIF segment with orientation 8")
+		}
+	})
+
+	t.Run("Nothing is written for upright images", func(t *testing.T) {
+		upright := testutil.MakeSegment(0xE1, testutil.Exif{IFD0: []testutil.Tag{testutil.Short(0x0112, 1)}}.Payload())
+
+		p := policyFor("exif")
+		p.Orientation = OrientationKeep
+		got := stripBytes(t, testutil.MakeJPEG(upright, sos), p)
+
+		if bytes.Contains(got, exifPrefix) {
+			t.Fatalf("unexpected EXIF segment for upright image")
+		}
+	})
+
+	t.Run("Default mode drops the tag", func(t *testing.T) {
+		got := stripBytes(t, testutil.MakeJPEG(exif, sos), policyFor("exif"))
+
+		if bytes.Contains(got, exifPrefix) {
+			t.Fatalf("unexpected EXIF segment")
+		}
+	})
+}
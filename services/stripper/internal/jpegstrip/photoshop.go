@@ -0,0 +1,175 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+)
+
+var photoshopPrefix = []byte("Photoshop 3.0\x00")
+
+// Photoshop image resource IDs stored in APP13
+const (
+	ResourceIPTC         uint16 = 0x0404 // IPTC-NAA record
+	ResourceThumbnailPS4 uint16 = 0x0409 // Photoshop 4.0 thumbnail
+	ResourceThumbnail    uint16 = 0x040C // Photoshop 5.0+ thumbnail
+	ResourceIPTCDigest   uint16 = 0x0425 // MD5 of the IPTC-NAA record
+	ResourceClippingPath uint16 = 0x0BB7 // Name of the clipping path, paths themselves are 0x07D0-0x0BB6
+)
+
+var errBadResources = errors.New("malformed Photoshop image resources")
+
+// Signatures used by image resource blocks in the wild; "8BIM" is by far the most common
+var resourceSignatures = [][]byte{
+	[]byte("8BIM"),
+	[]byte("PHUT"),
+	[]byte("AgHg"),
+	[]byte("DCSR"),
+	[]byte("MeSa"),
+}
+
+type imageResource struct {
+	signature []byte
+	id        uint16
+	name      []byte // Pascal string as stored, including the length byte and padding
+	data      []byte
+}
+
+func parseImageResources(b []byte) ([]imageResource, error) {
+	var resources []imageResource
+
+	for len(b) > 0 {
+		// Some writers pad the segment with zero bytes after the last block
+		if len(bytes.TrimLeft(b, "\x00")) == 0 {
+			break
+		}
+
+		if len(b) < 4 || !isResourceSignature(b[:4]) {
+			return nil, errBadResources
+		}
+		res := imageResource{signature: b[:4]}
+		b = b[4:]
+
+		if len(b) < 3 {
+			return nil, errBadResources
+		}
+		res.id = binary.BigEndian.Uint16(b)
+		b = b[2:]
+
+		nameLen := 1 + int(b[0])
+		nameLen += nameLen % 2
+		if len(b) < nameLen+4 {
+			return nil, errBadResources
+		}
+		res.name = b[:nameLen]
+		b = b[nameLen:]
+
+		size := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(size) > uint64(len(b)) {
+			return nil, errBadResources
+		}
+		res.data = b[:size]
+
+		padded := int(size) + int(size%2)
+		if padded > len(b) {
+			padded = len(b)
+		}
+		b = b[padded:]
+
+		resources = append(resources, res)
+	}
+
+	return resources, nil
+}
+
+func writeImageResources(resources []imageResource) []byte {
+	var b bytes.Buffer
+	for _, res := range resources {
+		b.Write(res.signature)
+
+		var n [4]byte
+		binary.BigEndian.PutUint16(n[:2], res.id)
+		b.Write(n[:2])
+		b.Write(res.name)
+
+		binary.BigEndian.PutUint32(n[:], uint32(len(res.data)))
+		b.Write(n[:])
+		b.Write(res.data)
+		if len(res.data)%2 == 1 {
+			b.WriteByte(0)
+		}
+	}
+	return b.Bytes()
+}
+
+func isResourceSignature(sig []byte) bool {
+	for _, s := range resourceSignatures {
+		if bytes.Equal(sig, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the listed resources from an APP13 payload. It reports false when
+// nothing is left and the segment should be dropped. A payload that cannot be
+// parsed is dropped as a whole, as its contents cannot be filtered reliably.
+func filterPhotoshop(payload []byte, drop map[uint16]bool) ([]byte, bool) {
+	resources, err := parseImageResources(payload[len(photoshopPrefix):])
+	if err != nil {
+		return nil, false
+	}
+
+	kept := resources[:0]
+	for _, res := range resources {
+		if !drop[res.id] {
+			kept = append(kept, res)
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil, false
+	}
+	if len(kept) == len(resources) {
+		return payload, true
+	}
+
+	return append(append([]byte{}, photoshopPrefix...), writeImageResources(kept)...), true
+}
+
+// Applies the policy to consecutive APP13 Photoshop segments and writes what
+// is kept. Writers split large resources over several segments, so their
+// payloads are joined, filtered as one and split again if anything changed.
+func writePhotoshop(out io.Writer, segs []segment, policy *Policy) error {
+	joined := slices.Clone(segs[0].payload)
+	for _, seg := range segs[1:] {
+		joined = append(joined, seg.payload[len(photoshopPrefix):]...)
+	}
+
+	kept, keep := policy.apply(0xED, joined)
+	if !keep {
+		return nil
+	}
+	if bytes.Equal(kept, joined) {
+		for _, seg := range segs {
+			if err := seg.writeTo(out); err != nil {
+				return writeFailed(seg, err)
+			}
+		}
+		return nil
+	}
+
+	data := kept[len(photoshopPrefix):]
+	for len(data) > 0 {
+		n := min(len(data), 0xFFFF-2-len(photoshopPrefix))
+		chunk := append(slices.Clone(photoshopPrefix), data[:n]...)
+		if err := writeSegment(out, 0xED, chunk); err != nil {
+			return writeFailed(segs[0], err)
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+// helper: encode one 8BIM image resource block with an empty name
+func makeResource(id uint16, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("8BIM")
+	binary.Write(&b, binary.BigEndian, id)
+	b.Write([]byte{0x00, 0x00}) // empty Pascal name, padded to even length
+	binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.Write(data)
+	if len(data)%2 == 1 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func makePhotoshopSegment(resources ...[]byte) []byte {
+	payload := append([]byte{}, photoshopPrefix...)
+	for _, r := range resources {
+		payload = append(payload, r...)
+	}
+	return testutil.MakeSegment(0xED, payload)
+}
+
+func stripBytes(t *testing.T, img []byte, p *Policy) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := Strip(bytes.NewReader(img), &out, p); err != nil {
+		t.Fatalf("Strip() unexpected error: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestParseImageResources(t *testing.T) {
+	t.Run("Parses blocks with odd sizes and names", func(t *testing.T) {
+		var b bytes.Buffer
+		b.WriteString("8BIM")
+		b.Write([]byte{0x07, 0xD0})
+		b.Write([]byte{0x04, 'P', 'a', 't', 'h', 0x00}) // name "Path" padded to 6 bytes
+		b.Write([]byte{0x00, 0x00, 0x00, 0x03, 'a', 'b', 'c', 0x00})
+		b.Write(makeResource(ResourceIPTC, []byte("iptc")))
+
+		resources, err := parseImageResources(b.Bytes())
+		if err != nil {
+			t.Fatalf("parseImageResources() unexpected error: %v", err)
+		}
+		if len(resources) != 2 {
+			t.Fatalf("want 2 resources, got %d", len(resources))
+		}
+		if resources[0].id != 0x07D0 || string(resources[0].data) != "abc" {
+			t.Fatalf("unexpected first resource: id=%#x data=%q", resources[0].id, resources[0].data)
+		}
+		if !bytes.Equal(writeImageResources(resources), b.Bytes()) {
+			t.Fatalf("re-encoded resources differ from input")
+		}
+	})
+
+	t.Run("Rejects unknown signature", func(t *testing.T) {
+		if _, err := parseImageResources([]byte("XXXX\x04\x04\x00\x00\x00\x00\x00\x00")); err == nil {
+			t.Fatalf("expected error for unknown signature")
+		}
+	})
+
+	t.Run("Rejects size past the end", func(t *testing.T) {
+		block := makeResource(ResourceIPTC, []byte("iptc"))
+		if _, err := parseImageResources(block[:len(block)-2]); err == nil {
+			t.Fatalf("expected error for truncated block")
+		}
+	})
+}
+
+func TestStripPhotoshop(t *testing.T) {
+	iptc := makeResource(ResourceIPTC, []byte("IPTC-RECORD"))
+	digest := makeResource(ResourceIPTCDigest, bytes.Repeat([]byte{0xAB}, 16))
+	thumb := makeResource(ResourceThumbnail, []byte("THUMBNAIL-PIXELS"))
+	clip := makeResource(ResourceClippingPath, []byte("CLIP"))
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+
+	t.Run("IPTC removes record and digest but keeps clipping path", func(t *testing.T) {
+		img := testutil.MakeJPEG(makePhotoshopSegment(iptc, digest, thumb, clip), sos)
+		got := stripBytes(t, img, policyFor("iptc"))
+
+		if bytes.Contains(got, []byte("IPTC-RECORD")) {
+			t.Fatalf("IPTC record not removed")
+		}
+		if bytes.Contains(got, []byte{0xAB, 0xAB, 0xAB, 0xAB}) {
+			t.Fatalf("IPTC digest not removed")
+		}
+		if !bytes.Contains(got, []byte("THUMBNAIL-PIXELS")) || !bytes.Contains(got, []byte("CLIP")) {
+			t.Fatalf("expected thumbnail and clipping path to be preserved")
+		}
+	})
+
+	t.Run("Segment is removed when no resources are left", func(t *testing.T) {
+		img := testutil.MakeJPEG(makePhotoshopSegment(iptc, digest), sos)
+		got := stripBytes(t, img, policyFor("iptc"))
+
+		if testutil.ContainsMarker(got, 0xED) {
+			t.Fatalf("expected empty APP13 to be removed")
+		}
+	})
+
+	t.Run("IPTC and thumbnail combined", func(t *testing.T) {
+		img := testutil.MakeJPEG(makePhotoshopSegment(iptc, thumb, clip), sos)
+		got := stripBytes(t, img, policyFor("iptc", "photoshop:thumbnail"))
+
+		if bytes.Contains(got, []byte("IPTC-RECORD")) || bytes.Contains(got, []byte("THUMBNAIL-PIXELS")) {
+			t.Fatalf("IPTC or thumbnail not removed")
+		}
+		if !bytes.Contains(got, []byte("CLIP")) {
+			t.Fatalf("expected clipping path to be preserved")
+		}
+	})
+
+	t.Run("Photoshop removes the whole segment", func(t *testing.T) {
+		img := testutil.MakeJPEG(makePhotoshopSegment(clip), sos)
+		got := stripBytes(t, img, policyFor("photoshop"))
+
+		if testutil.ContainsMarker(got, 0xED) {
+			t.Fatalf("APP13 not removed")
+		}
+	})
+
+	t.Run("Malformed resources are dropped when filtering", func(t *testing.T) {
+		broken := testutil.MakeSegment(0xED, append(append([]byte{}, photoshopPrefix...), "8BIM\x04"...))
+		img := testutil.MakeJPEG(broken, sos)
+		got := stripBytes(t, img, policyFor("iptc"))
+
+		if testutil.ContainsMarker(got, 0xED) {
+			t.Fatalf("expected malformed APP13 to be removed")
+		}
+	})
+
+	t.Run("Resources split over several segments are filtered together", func(t *testing.T) {
+		irb := append(append(append([]byte{}, iptc...), digest...), clip...)
+		cut := len(iptc) + 3
+		first := testutil.MakeSegment(0xED, append(append([]byte{}, photoshopPrefix...), irb[:cut]...))
+		second := testutil.MakeSegment(0xED, append(append([]byte{}, photoshopPrefix...), irb[cut:]...))
+
+		img := testutil.MakeJPEG(first, second, sos)
+		got := stripBytes(t, img, policyFor("iptc"))
+
+		if bytes.Contains(got, []byte("IPTC-RECORD")) {
+			t.Fatalf("IPTC record not removed")
+		}
+		if !bytes.Contains(got, []byte("CLIP")) {
+			t.Fatalf("expected clipping path to be preserved")
+		}
+
+		if got := stripBytes(t, img, policyFor("exif")); !bytes.Equal(got, img) {
+			t.Fatalf("expected split segments to be unchanged without Photoshop rules")
+		}
+	})
+
+	t.Run("APP13 untouched without Photoshop rules", func(t *testing.T) {
+		img := testutil.MakeJPEG(makePhotoshopSegment(iptc, clip), sos)
+		got := stripBytes(t, img, policyFor("exif"))
+
+		if !bytes.Equal(got, img) {
+			t.Fatalf("expected image to be unchanged")
+		}
+	})
+}
@@ -0,0 +1,304 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// Rule matches segments that Strip removes. A rule without a Prefix matches
+// every segment carrying Marker.
+type Rule struct {
+	Marker byte
+	Prefix []byte
+}
+
+// Policy is the set of rules Strip applies to an image. A marker can have any
+// number of prefix rules, and a rule without a prefix drops the whole marker
+// regardless of the prefix rules registered next to it.
+type Policy struct {
+	Orientation OrientationMode
+	Trailer     TrailerMode // bytes after EOI that are not MPF images
+	Secondary   SecondaryMode
+
+	// Allowlist turns the policy around: Strip keeps only the segments needed
+	// to decode the image and drops everything else, including segment kinds
+	// it has never heard of. KeepJFIF and KeepICC let APP0 JFIF and the ICC
+	// profile through as well. The MPF index stays while the secondary images
+	// it lists are kept.
+	Allowlist bool
+	KeepJFIF  bool
+	KeepICC   bool
+
+	// Mode decides what happens to damaged input, see ParseMode
+	Mode ParseMode
+	// Limits bounds what one image may cost, zero fields take DefaultLimits
+	Limits Limits
+	Layout LayoutMode // LayoutCanonical rewrites the structure, see LayoutMode
+
+	rules     map[byte][]Rule
+	resources map[uint16]bool // Photoshop image resources removed from APP13
+	exifTags  map[ExifTag]bool
+	xmpProps  map[XMPProperty]bool
+	gpsKM     float64 // grid size the GPS position is rounded to, 0 to leave it alone
+	times     TimeEdit
+	thumbnail bool // remove EXIF IFD1 and its thumbnail
+	jfifThumb bool // rewrite APP0 JFIF without its thumbnail
+	keepMPF   bool // allowlist mode keeps the MPF index for the images it points at
+
+	jumbfLabels map[string]bool // labels of the APP11 JUMBF boxes removed
+}
+
+func NewPolicy(rules ...Rule) *Policy {
+	// The maps are created by the methods that fill them
+	p := &Policy{}
+	p.Add(rules...)
+	return p
+}
+
+func (p *Policy) Add(rules ...Rule) {
+	if p.rules == nil {
+		p.rules = make(map[byte][]Rule)
+	}
+	for _, r := range rules {
+		p.rules[r.Marker] = append(p.rules[r.Marker], r)
+	}
+}
+
+// DropResources removes the given Photoshop image resources from APP13
+// segments while keeping the others, such as clipping paths.
+func (p *Policy) DropResources(ids ...uint16) {
+	if p.resources == nil {
+		p.resources = make(map[uint16]bool)
+	}
+	for _, id := range ids {
+		p.resources[id] = true
+	}
+}
+
+// RemoveExifTags rewrites APP1 EXIF segments without the given tags and
+// keeps the rest of the EXIF data.
+func (p *Policy) RemoveExifTags(tags ...ExifTag) {
+	if p.exifTags == nil {
+		p.exifTags = make(map[ExifTag]bool)
+	}
+	for _, tag := range tags {
+		p.exifTags[tag] = true
+	}
+}
+
+// CoarsenGPS rounds the EXIF GPS position to a grid of roughly km kilometres
+// and removes the other GPS tags, such as altitude and timestamps.
+func (p *Policy) CoarsenGPS(km float64) {
+	p.gpsKM = km
+}
+
+// RemoveThumbnail rewrites APP1 EXIF segments without IFD1 and the JPEG
+// thumbnail it holds, which may still show an uncropped original.
+func (p *Policy) RemoveThumbnail() {
+	p.thumbnail = true
+}
+
+// EditTimes shifts or truncates the dates in EXIF, XMP and IPTC metadata.
+// Edits replace each other rather than add up.
+func (p *Policy) EditTimes(e TimeEdit) {
+	p.times = e
+}
+
+// DropJUMBF removes the APP11 JUMBF boxes with the given labels, such as
+// "c2pa", with every segment they are split over.
+func (p *Policy) DropJUMBF(labels ...string) {
+	if p.jumbfLabels == nil {
+		p.jumbfLabels = make(map[string]bool)
+	}
+	for _, l := range labels {
+		p.jumbfLabels[l] = true
+	}
+}
+
+// RemoveXMP rewrites the main APP1 XMP packet without the given properties
+// and keeps the rest of it.
+func (p *Policy) RemoveXMP(props ...XMPProperty) {
+	if p.xmpProps == nil {
+		p.xmpProps = make(map[XMPProperty]bool)
+	}
+	for _, prop := range props {
+		p.xmpProps[prop] = true
+	}
+}
+
+// AddType adds the rules for a metadata type name such as "exif" or "xmp".
+// It reports false when the name is unknown.
+func (p *Policy) AddType(metaType string) bool {
+	name := strings.ToLower(strings.TrimSpace(metaType))
+
+	if rules, ok := MarkerFor(name); ok {
+		p.Add(rules...)
+		return true
+	}
+
+	if tags, ok := exifTagGroups[name]; ok {
+		p.RemoveExifTags(tags...)
+		return true
+	}
+
+	if props, ok := xmpGroups[name]; ok {
+		p.RemoveXMP(props...)
+		return true
+	}
+
+	if v, ok := strings.CutPrefix(name, "gps:coarsen="); ok {
+		km, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(km > 0 && km <= 20000) {
+			return false
+		}
+		p.CoarsenGPS(km)
+		return true
+	}
+
+	if v, ok := strings.CutPrefix(name, "time:shift="); ok {
+		d, ok := parseShift(v)
+		if !ok {
+			return false
+		}
+		p.times.Shift = d
+		return true
+	}
+
+	switch name {
+	case "time:truncate=day":
+		p.times.Truncate = TruncateDay
+	case "time:truncate=month":
+		p.times.Truncate = TruncateMonth
+	case "iptc":
+		// The digest describes the removed record, so it goes too
+		p.DropResources(ResourceIPTC, ResourceIPTCDigest)
+	case "thumbnail":
+		p.RemoveThumbnail()
+	case "jfif:thumbnail":
+		// JFXX extensions exist to carry thumbnails
+		p.Add(Rule{Marker: 0xE0, Prefix: jfxxPrefix})
+		p.jfifThumb = true
+	case "c2pa":
+		p.DropJUMBF(c2paLabel)
+	case "photoshop:thumbnail":
+		p.DropResources(ResourceThumbnailPS4, ResourceThumbnail)
+	case "trailer":
+		p.Trailer = TrailerDrop
+	case "xmp:extended":
+		// Readers must not go looking for an extension that is gone
+		p.Add(Rule{Marker: 0xE1, Prefix: xmpExtensionPrefix})
+		p.RemoveXMP(XMPHasExtendedPointer)
+	case "mpf:images":
+		p.Secondary = SecondaryDrop
+	case "all":
+		p.Allowlist = true
+		p.Trailer = TrailerDrop
+		p.Secondary = SecondaryDrop
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Drops reports whether a segment with the given marker and payload matches
+// any rule of the policy. A nil policy drops nothing.
+func (p *Policy) Drops(marker byte, payload []byte) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, r := range p.rules[marker] {
+		if len(r.Prefix) == 0 || bytes.HasPrefix(payload, r.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the payload Strip should write for a segment, or false when the
+// segment is removed.
+func (p *Policy) apply(marker byte, payload []byte) ([]byte, bool) {
+	if p == nil {
+		return payload, true
+	}
+
+	if p.Allowlist && !p.allows(marker, payload) {
+		return nil, false
+	}
+
+	if p.Drops(marker, payload) {
+		return nil, false
+	}
+
+	// Allowlist mode keeps no preview pixels
+	if marker == 0xE0 && (p.jfifThumb || p.Allowlist) && bytes.HasPrefix(payload, jfifPrefix) {
+		return plainJFIF(payload)
+	}
+
+	if marker == 0xE1 && (len(p.xmpProps) > 0 || !p.times.isZero()) && bytes.HasPrefix(payload, xmpPrefix) {
+		edit := xmpEdit{remove: p.xmpProps}
+		if !p.times.isZero() {
+			edit.value = xmpDateRewriter(p.times)
+		}
+		return editXMP(payload, edit)
+	}
+
+	if marker == 0xE1 && bytes.HasPrefix(payload, exifPrefix) {
+		keep := true
+		if len(p.exifTags) > 0 {
+			payload, keep = editExif(payload, p.exifTags)
+		}
+		if keep && p.thumbnail {
+			payload, keep = removeThumbnail(payload)
+		}
+		if keep && !p.times.isZero() {
+			payload, keep = editExifTimes(payload, p.times)
+		}
+		if keep && p.gpsKM > 0 {
+			payload, keep = coarsenGPS(payload, p.gpsKM)
+		}
+		return payload, keep
+	}
+
+	if marker == 0xED && bytes.HasPrefix(payload, photoshopPrefix) {
+		drop := p.resources
+		if !p.times.isZero() {
+			var changed bool
+			payload, changed = editIPTCTimes(payload, p.times)
+			if changed {
+				// The digest describes the old record
+				stale := map[uint16]bool{ResourceIPTCDigest: true}
+				maps.Copy(stale, drop)
+				drop = stale
+			}
+		}
+		if len(drop) > 0 {
+			return filterPhotoshop(payload, drop)
+		}
+	}
+
+	return payload, true
+}
+
+// Reports whether allowlist mode keeps a segment
+func (p *Policy) allows(marker byte, payload []byte) bool {
+	switch {
+	case isImageMarker(marker):
+		return true
+	case marker == 0xEE && bytes.HasPrefix(payload, adobePrefix):
+		// Only the transform flag matters for decoding. YCbCr is what decoders
+		// assume without the segment, anything else has to stay.
+		return len(payload) >= 12 && payload[11] != 1
+	case marker == 0xE0 && bytes.HasPrefix(payload, jfifPrefix):
+		return p.KeepJFIF
+	case marker == 0xE2 && bytes.HasPrefix(payload, iccPrefix):
+		return p.KeepICC
+	case marker == 0xE2 && bytes.HasPrefix(payload, mpfPrefix):
+		return p.keepMPF
+	default:
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+package jpegstrip
+
+import "io"
+
+// ParseMode decides how damaged or unusual files are handled
+type ParseMode int
+
+const (
+	// ParseDefault skips stray bytes and fill in front of markers, and
+	// rejects files that end before EOI
+	ParseDefault ParseMode = iota
+	// ParseStrict rejects stray bytes and markers out of place. Fill bytes
+	// are valid JPEG, so they are removed and reported as in ParseDefault.
+	ParseStrict
+	// ParseLenient also recovers files that end early, as cameras leave them
+	// when the card is pulled: the partial segment is dropped, whatever scan
+	// data exists is kept and EOI is added
+	ParseLenient
+)
+
+// RepairKind names a change made to get through a file
+type RepairKind string
+
+const (
+	RepairSkippedBytes   RepairKind = "skipped_bytes"   // bytes that are not a marker, before one
+	RepairRemovedFill    RepairKind = "removed_fill"    // extra 0xFF bytes in front of a marker
+	RepairTruncatedScan  RepairKind = "truncated_scan"  // scan data ends early and is kept as is
+	RepairDroppedSegment RepairKind = "dropped_segment" // segment cut off by the end of the input
+	RepairAddedEOI       RepairKind = "added_eoi"
+)
+
+// Repair is one change made while reading a file, at an input offset
+type Repair struct {
+	Offset int64      `json:"offset"`
+	Kind   RepairKind `json:"kind"`
+	Length int64      `json:"length,omitempty"` // bytes skipped or dropped
+}
+
+func (p *Policy) parseMode() ParseMode {
+	if p == nil {
+		return ParseDefault
+	}
+	return p.Mode
+}
+
+// ParseModeFor returns the parse mode named by a mode option
+func ParseModeFor(name string) (ParseMode, bool) {
+	switch name {
+	case "", "default":
+		return ParseDefault, true
+	case "strict":
+		return ParseStrict, true
+	case "lenient":
+		return ParseLenient, true
+	default:
+		return 0, false
+	}
+}
+
+// Ends the image where the input ended, in lenient mode. It reports false
+// in the other modes, where the read error stands.
+func (sr *segmentReader) recoverEOF(err error) (segment, bool) {
+	if sr.mode != ParseLenient || !isEOF(err) {
+		return segment{}, false
+	}
+	sr.repair(sr.off, RepairAddedEOI, 0)
+	return segment{marker: 0xD9, offset: sr.off}, true
+}
+
+func (sr *segmentReader) repair(offset int64, kind RepairKind, length int64) {
+	sr.repairs = append(sr.repairs, Repair{Offset: offset, Kind: kind, Length: length})
+}
+
+func isEOF(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,152 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"reflect"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestParseModes(t *testing.T) {
+	sof := testutil.MakeSegment(0xC0, []byte{8, 0, 1, 0, 1, 1, 1, 0x11, 0})
+	sos := testutil.MakeSOS([]byte{0x11, 0x22, 0x33})
+	com := testutil.MakeSegment(0xFE, []byte("hi"))
+
+	strip := func(t *testing.T, img []byte, mode ParseMode) ([]byte, []Repair, error) {
+		t.Helper()
+		p := NewPolicy()
+		p.Mode = mode
+		var out bytes.Buffer
+		repairs, err := StripWithRepairs(bytes.NewReader(img), &out, p)
+		return out.Bytes(), repairs, err
+	}
+
+	// SOI, COM, 3 stray bytes and 2 fill bytes, then SOF, SOS and EOI
+	messy := testutil.MakeJPEG(com, append([]byte{1, 2, 3, 0xFF, 0xFF}, sof...), sos)
+	clean := testutil.MakeJPEG(com, sof, sos)
+
+	t.Run("Default mode skips and reports stray bytes and fill", func(t *testing.T) {
+		got, repairs, err := strip(t, messy, ParseDefault)
+		if err != nil {
+			t.Fatalf("StripWithRepairs: %v", err)
+		}
+		if !bytes.Equal(got, clean) {
+			t.Fatalf("unexpected output % X", got)
+		}
+		want := []Repair{
+			{Offset: 8, Kind: RepairSkippedBytes, Length: 3},
+			{Offset: 11, Kind: RepairRemovedFill, Length: 2},
+		}
+		if !reflect.DeepEqual(repairs, want) {
+			t.Fatalf("repairs are %+v, want %+v", repairs, want)
+		}
+	})
+
+	t.Run("Strict mode rejects stray bytes and reports fill", func(t *testing.T) {
+		_, _, err := strip(t, messy, ParseStrict)
+		var e *Error
+		if !errors.As(err, &e) || e.Reason != ReasonStrayBytes || e.Offset != 8 {
+			t.Fatalf("expected stray bytes at 8, got %v", err)
+		}
+
+		fill := testutil.MakeJPEG(com, append([]byte{0xFF}, sof...), sos)
+		got, repairs, err := strip(t, fill, ParseStrict)
+		if err != nil {
+			t.Fatalf("fill bytes: %v", err)
+		}
+		if want := []Repair{{Offset: 8, Kind: RepairRemovedFill, Length: 1}}; !bytes.Equal(got, clean) || !reflect.DeepEqual(repairs, want) {
+			t.Fatalf("repairs are %+v, want %+v", repairs, want)
+		}
+		if _, repairs, err := strip(t, clean, ParseStrict); err != nil || repairs != nil {
+			t.Fatalf("clean file: %v, %+v", err, repairs)
+		}
+	})
+
+	t.Run("Strict mode rejects markers out of place", func(t *testing.T) {
+		for name, img := range map[string][]byte{
+			"scan before frame": testutil.MakeJPEG(com, sos),
+			"second SOI":        testutil.MakeJPEG([]byte{0xFF, 0xD8}, sof, sos),
+			"restart marker":    testutil.MakeJPEG([]byte{0xFF, 0xD0}, sof, sos),
+			"reserved marker":   testutil.MakeJPEG(testutil.MakeSegment(0x02, []byte{0}), sof, sos),
+		} {
+			_, _, err := strip(t, img, ParseStrict)
+			var e *Error
+			if !errors.As(err, &e) || e.Reason != ReasonNonCanonical || !errors.Is(err, ErrTruncated) {
+				t.Fatalf("%s: expected a non-canonical error, got %v", name, err)
+			}
+			if _, _, err := strip(t, img, ParseDefault); err != nil {
+				t.Fatalf("%s: default mode: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("Lenient mode ends a cut off scan", func(t *testing.T) {
+		img := clean[:len(clean)-3] // EOI and the last scan byte
+		got, repairs, err := strip(t, img, ParseLenient)
+		if err != nil {
+			t.Fatalf("StripWithRepairs: %v", err)
+		}
+		if want := append(append([]byte{}, img...), 0xFF, 0xD9); !bytes.Equal(got, want) {
+			t.Fatalf("unexpected output % X", got)
+		}
+		end := int64(len(img))
+		want := []Repair{{Offset: end, Kind: RepairTruncatedScan}, {Offset: end, Kind: RepairAddedEOI}}
+		if !reflect.DeepEqual(repairs, want) {
+			t.Fatalf("repairs are %+v, want %+v", repairs, want)
+		}
+
+		if _, _, err := strip(t, img, ParseDefault); !errors.Is(err, ErrTruncated) {
+			t.Fatalf("default mode: expected ErrTruncated, got %v", err)
+		}
+	})
+
+	t.Run("Lenient mode drops a cut off segment", func(t *testing.T) {
+		img := testutil.MakeJPEG(sof, com)
+		img = img[:len(img)-4] // EOI and half of the comment
+		got, repairs, err := strip(t, img, ParseLenient)
+		if err != nil {
+			t.Fatalf("StripWithRepairs: %v", err)
+		}
+		start := int64(2 + len(sof))
+		if want := append(append([]byte{}, img[:start]...), 0xFF, 0xD9); !bytes.Equal(got, want) {
+			t.Fatalf("unexpected output % X", got)
+		}
+		want := []Repair{{Offset: start, Kind: RepairDroppedSegment, Length: 4}, {Offset: start, Kind: RepairAddedEOI}}
+		if !reflect.DeepEqual(repairs, want) {
+			t.Fatalf("repairs are %+v, want %+v", repairs, want)
+		}
+	})
+
+	t.Run("Lenient mode recovers a truncated camera file", func(t *testing.T) {
+		file := makePicture(t, 64, 64, image.Rect(0, 0, 64, 64), false)
+		cut := file[:len(file)*2/3]
+
+		got, _, err := strip(t, cut, ParseLenient)
+		if err != nil {
+			t.Fatalf("StripWithRepairs: %v", err)
+		}
+		if !bytes.HasPrefix(got, cut[:len(cut)-1]) {
+			t.Fatalf("expected the scan data to be kept")
+		}
+		// image/jpeg gives up on short scans, so only the structure is checked
+		if _, repairs, err := strip(t, got, ParseStrict); err != nil || repairs != nil {
+			t.Fatalf("recovered file: %v, %+v", err, repairs)
+		}
+	})
+
+	t.Run("Inspect lists the repairs", func(t *testing.T) {
+		report, err := InspectMode(bytes.NewReader(messy), ParseLenient, DefaultLimits)
+		if err != nil {
+			t.Fatalf("InspectMode: %v", err)
+		}
+		if len(report.Repairs) != 2 || report.Repairs[0].Kind != RepairSkippedBytes {
+			t.Fatalf("unexpected repairs %+v", report.Repairs)
+		}
+		if _, err := InspectMode(bytes.NewReader(messy), ParseStrict, DefaultLimits); err == nil {
+			t.Fatalf("expected strict mode to fail")
+		}
+	})
+}
@@ -0,0 +1,597 @@
+package jpegstrip
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errUnsupportedTransform = errors.New("image layout not supported by lossless transform")
+
+// A lossless transform of the DCT coefficients. The image is transposed
+// first, then flipped horizontally and/or vertically.
+type transform struct {
+	transpose bool
+	flipH     bool
+	flipV     bool
+}
+
+// Transforms that bring an image with the given EXIF orientation upright
+var orientationTransforms = [9]transform{
+	2: {flipH: true},
+	3: {flipH: true, flipV: true},
+	4: {flipV: true},
+	5: {transpose: true},
+	6: {transpose: true, flipH: true},
+	7: {transpose: true, flipH: true, flipV: true},
+	8: {transpose: true, flipV: true},
+}
+
+type component struct {
+	id     byte
+	h, v   int  // sampling factors
+	tq     byte // quantization table
+	td, ta byte // DC and AC Huffman tables used by the scans
+	bw, bh int  // block grid, padded to whole MCUs
+	blocks [][64]int16
+	dc     []int16 // DC coefficients alone, when only a preview is decoded
+	done   bool
+}
+
+// coeffImage is a baseline or extended sequential Huffman JPEG decoded down
+// to its quantized DCT coefficients, which is enough to rotate it losslessly.
+type coeffImage struct {
+	sof           byte
+	width, height int
+	comps         []*component
+	hmax, vmax    int
+	mcusX, mcusY  int
+	qt            [4][]byte // DQT entries: precision/ID byte followed by the table
+	dc, ac        [4]*huffTable
+	restart       int
+	extra         []rawSegment // APPn and COM segments, carried over unchanged
+	trailer       []byte       // bytes after EOI, carried over unchanged
+	dcOnly        bool         // keep the DC coefficients of the first component only
+}
+
+type rawSegment struct {
+	marker  byte
+	payload []byte
+}
+
+func decodeCoefficients(data []byte, limits Limits) (*coeffImage, error) {
+	return decodeFrame(data, limits, false)
+}
+
+func decodeFrame(data []byte, limits Limits, dcOnly bool) (*coeffImage, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrNotJPEG
+	}
+
+	// The coefficients of every block are held in memory, so the frame size
+	// is checked before they are allocated
+	fits := func(width, height int) bool { return limits.decodable(width, height, len(data)) }
+
+	img := &coeffImage{dcOnly: dcOnly}
+	pos := 2
+	for {
+		for pos < len(data) && data[pos] != 0xFF {
+			pos++
+		}
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, ErrTruncated
+		}
+		marker := data[pos]
+		pos++
+
+		if marker == 0xD9 {
+			img.trailer = data[pos:]
+			break
+		}
+		if isNoLengthMarker(marker) {
+			return nil, errUnsupportedTransform
+		}
+
+		if pos+2 > len(data) {
+			return nil, ErrTruncated
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, ErrTruncated
+		}
+		payload := data[pos+2 : pos+length]
+		pos += length
+
+		var err error
+		switch {
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+			img.extra = append(img.extra, rawSegment{marker, payload})
+		case marker == 0xDB:
+			err = img.parseDQT(payload)
+		case marker == 0xC4:
+			err = parseDHT(payload, func(class, id byte, t *huffTable) {
+				if class == 0 {
+					img.dc[id] = t
+				} else {
+					img.ac[id] = t
+				}
+			})
+		case marker == 0xDD:
+			if len(payload) < 2 {
+				return nil, ErrTruncated
+			}
+			img.restart = int(binary.BigEndian.Uint16(payload))
+		case marker == 0xC0, marker == 0xC1:
+			err = img.parseSOF(marker, payload, fits)
+		case marker == 0xDA:
+			var n int
+			n, err = img.decodeScan(payload, data[pos:])
+			pos += n
+		default:
+			// Progressive, lossless and arithmetic-coded frames, DNL and the rest
+			return nil, errUnsupportedTransform
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if img.comps == nil {
+		return nil, errUnsupportedTransform
+	}
+	for _, c := range img.comps {
+		if !c.done {
+			return nil, errUnsupportedTransform
+		}
+	}
+
+	return img, nil
+}
+
+func (img *coeffImage) parseDQT(payload []byte) error {
+	for len(payload) > 0 {
+		size := 65
+		if payload[0]>>4 != 0 {
+			size = 129
+		}
+		id := payload[0] & 0x0F
+		if id > 3 || len(payload) < size {
+			return ErrTruncated
+		}
+		img.qt[id] = append([]byte{}, payload[:size]...)
+		payload = payload[size:]
+	}
+	return nil
+}
+
+func (img *coeffImage) parseSOF(marker byte, payload []byte, fits func(width, height int) bool) error {
+	if img.comps != nil {
+		return errUnsupportedTransform
+	}
+	if len(payload) < 6 {
+		return ErrTruncated
+	}
+	if payload[0] != 8 {
+		return errUnsupportedTransform
+	}
+
+	img.sof = marker
+	img.height = int(binary.BigEndian.Uint16(payload[1:]))
+	img.width = int(binary.BigEndian.Uint16(payload[3:]))
+	n := int(payload[5])
+	if img.width == 0 || img.height == 0 || n == 0 || n > 4 || len(payload) < 6+3*n {
+		return errUnsupportedTransform
+	}
+	if !fits(img.width, img.height) {
+		return ErrLimitExceeded
+	}
+
+	for i := 0; i < n; i++ {
+		c := payload[6+3*i:]
+		comp := &component{id: c[0], h: int(c[1] >> 4), v: int(c[1] & 0x0F), tq: c[2]}
+		if comp.h < 1 || comp.h > 4 || comp.v < 1 || comp.v > 4 || comp.tq > 3 {
+			return errUnsupportedTransform
+		}
+		img.comps = append(img.comps, comp)
+	}
+
+	// A single component is coded block by block whatever its sampling factors
+	if n == 1 {
+		img.comps[0].h, img.comps[0].v = 1, 1
+	}
+
+	img.layout()
+	for i, c := range img.comps {
+		switch {
+		case !img.dcOnly:
+			c.blocks = make([][64]int16, c.bw*c.bh)
+		case i == 0:
+			c.dc = make([]int16, c.bw*c.bh)
+		}
+	}
+	return nil
+}
+
+// Derives the MCU grid and the padded block grid of every component
+func (img *coeffImage) layout() {
+	img.hmax, img.vmax = 1, 1
+	for _, c := range img.comps {
+		img.hmax = max(img.hmax, c.h)
+		img.vmax = max(img.vmax, c.v)
+	}
+	img.mcusX = ceilDiv(img.width, 8*img.hmax)
+	img.mcusY = ceilDiv(img.height, 8*img.vmax)
+	for _, c := range img.comps {
+		c.bw, c.bh = img.mcusX*c.h, img.mcusY*c.v
+	}
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// Returns the scan components and block visiting order shared by the
+// decoder and encoder, with each block as an index into the block grid of
+// its component. Single-component scans visit only the blocks inside the
+// image; interleaved scans visit whole MCUs.
+func (img *coeffImage) eachBlock(comps []*component, fn func(ci, mcu, blk int) error) error {
+	if len(comps) == 1 {
+		c := comps[0]
+		w := ceilDiv(ceilDiv(img.width*c.h, img.hmax), 8)
+		h := ceilDiv(ceilDiv(img.height*c.v, img.vmax), 8)
+		for i := 0; i < w*h; i++ {
+			if err := fn(0, i, (i/w)*c.bw+i%w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for m := 0; m < img.mcusX*img.mcusY; m++ {
+		mx, my := m%img.mcusX, m/img.mcusX
+		for ci, c := range comps {
+			for v := 0; v < c.v; v++ {
+				for h := 0; h < c.h; h++ {
+					if err := fn(ci, m, (my*c.v+v)*c.bw+mx*c.h+h); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Decodes one sequential scan and returns the length of its entropy-coded data
+func (img *coeffImage) decodeScan(header, data []byte) (int, error) {
+	if img.comps == nil || len(header) < 1 {
+		return 0, errUnsupportedTransform
+	}
+	n := int(header[0])
+	if n == 0 || len(header) < 1+2*n+3 {
+		return 0, ErrTruncated
+	}
+
+	var comps []*component
+	for i := 0; i < n; i++ {
+		sel := header[1+2*i:]
+		var comp *component
+		for _, c := range img.comps {
+			if c.id == sel[0] {
+				comp = c
+			}
+		}
+		td, ta := sel[1]>>4, sel[1]&0x0F
+		if comp == nil || td > 3 || ta > 3 || img.dc[td] == nil || img.ac[ta] == nil {
+			return 0, errUnsupportedTransform
+		}
+		comp.td, comp.ta = td, ta
+		comps = append(comps, comp)
+	}
+
+	spectral := header[1+2*n:]
+	if spectral[0] != 0 || spectral[1] != 63 || spectral[2] != 0 {
+		return 0, errUnsupportedTransform
+	}
+
+	br := &bitReader{data: data}
+	preds := make([]int32, len(comps))
+	lastMCU := 0
+	var scratch [64]int16
+	err := img.eachBlock(comps, func(ci, mcu, i int) error {
+		if mcu != lastMCU && img.restart > 0 && mcu%img.restart == 0 {
+			if err := br.restart(); err != nil {
+				return err
+			}
+			clear(preds)
+		}
+		lastMCU = mcu
+
+		c := comps[ci]
+		if !img.dcOnly {
+			return decodeBlock(br, img.dc[c.td], img.ac[c.ta], &c.blocks[i], &preds[ci])
+		}
+		if err := decodeBlock(br, img.dc[c.td], img.ac[c.ta], &scratch, &preds[ci]); err != nil {
+			return err
+		}
+		if c.dc != nil {
+			c.dc[i] = scratch[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range comps {
+		c.done = true
+	}
+	return entropyEnd(data), nil
+}
+
+func decodeBlock(br *bitReader, dc, ac *huffTable, blk *[64]int16, pred *int32) error {
+	t, err := br.decode(dc)
+	if err != nil {
+		return err
+	}
+	if t > 11 {
+		return errBadHuffman
+	}
+	*pred += br.receiveExtend(t)
+	blk[0] = int16(*pred)
+
+	for k := 1; k < 64; {
+		rs, err := br.decode(ac)
+		if err != nil {
+			return err
+		}
+		r, s := int(rs>>4), rs&0x0F
+		if s == 0 {
+			if r != 15 {
+				break
+			}
+			k += 16
+			continue
+		}
+		k += r
+		if k > 63 {
+			return errBadHuffman
+		}
+		blk[zigzag[k]] = int16(br.receiveExtend(s))
+		k++
+	}
+	if br.overrun {
+		return ErrTruncated
+	}
+	return nil
+}
+
+// Returns the index of the marker that ends the entropy-coded data, skipping
+// stuffed zero bytes and restart markers
+func entropyEnd(data []byte) int {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		next := data[i+1]
+		if next == 0x00 || (next >= 0xD0 && next <= 0xD7) {
+			i++
+			continue
+		}
+		return i
+	}
+	return len(data)
+}
+
+// Applies a transform to the coefficients. Partial MCUs on an edge that ends
+// up flipped cannot be moved losslessly, and the image would have to be
+// trimmed, so those transforms are refused.
+func (img *coeffImage) transform(t transform) error {
+	width, height := img.width, img.height
+	hmax, vmax := img.hmax, img.vmax
+	if t.transpose {
+		width, height = height, width
+		hmax, vmax = vmax, hmax
+	}
+	if t.flipH && width%(8*hmax) != 0 || t.flipV && height%(8*vmax) != 0 {
+		return errUnsupportedTransform
+	}
+
+	mcusX, mcusY := ceilDiv(width, 8*hmax), ceilDiv(height, 8*vmax)
+	for _, c := range img.comps {
+		h, v := c.h, c.v
+		if t.transpose {
+			h, v = v, h
+		}
+		bw, bh := mcusX*h, mcusY*v
+
+		out := make([][64]int16, bw*bh)
+		for by := 0; by < bh; by++ {
+			for bx := 0; bx < bw; bx++ {
+				x, y := bx, by
+				if t.flipH {
+					x = bw - 1 - bx
+				}
+				if t.flipV {
+					y = bh - 1 - by
+				}
+				if t.transpose {
+					x, y = y, x
+				}
+				if x < 0 || y < 0 || x >= c.bw || y >= c.bh {
+					continue
+				}
+				transformBlock(&out[by*bw+bx], &c.blocks[y*c.bw+x], t)
+			}
+		}
+
+		c.h, c.v, c.bw, c.bh, c.blocks = h, v, bw, bh, out
+	}
+
+	img.width, img.height = width, height
+	img.layout()
+
+	if t.transpose {
+		for _, q := range img.qt {
+			if q != nil {
+				transposeDQT(q)
+			}
+		}
+	}
+	return nil
+}
+
+func transformBlock(dst, src *[64]int16, t transform) {
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			val := src[v*8+u]
+			if t.transpose {
+				val = src[u*8+v]
+			}
+			if (t.flipH && u%2 == 1) != (t.flipV && v%2 == 1) {
+				val = -val
+			}
+			dst[v*8+u] = val
+		}
+	}
+}
+
+// Transposes a DQT entry in place; its values are stored in zigzag order
+func transposeDQT(q []byte) {
+	size := 1
+	if q[0]>>4 != 0 {
+		size = 2
+	}
+	var natural [64][2]byte
+	for k := 0; k < 64; k++ {
+		copy(natural[zigzag[k]][:], q[1+size*k:1+size*k+size])
+	}
+	for k := 0; k < 64; k++ {
+		n := zigzag[k]
+		copy(q[1+size*k:], natural[(n%8)*8+n/8][:size])
+	}
+}
+
+// Encodes the image as a single interleaved scan with optimized Huffman tables
+func (img *coeffImage) encode() []byte {
+	var dcFreq, acFreq [4][256]int
+	img.encodeScan(func(class, id, sym byte) {
+		if class == 0 {
+			dcFreq[id][sym]++
+		} else {
+			acFreq[id][sym]++
+		}
+	}, nil)
+
+	var dht []byte
+	used := make(map[[2]byte]bool)
+	for _, c := range img.comps {
+		for class, id := range [2]byte{c.td, c.ta} {
+			key := [2]byte{byte(class), id}
+			if used[key] {
+				continue
+			}
+			used[key] = true
+			if class == 0 {
+				img.dc[id] = optimalHuffTable(&dcFreq[id])
+				dht = appendDHT(dht, 0, id, img.dc[id])
+			} else {
+				img.ac[id] = optimalHuffTable(&acFreq[id])
+				dht = appendDHT(dht, 1, id, img.ac[id])
+			}
+		}
+	}
+
+	bw := &bitWriter{}
+	img.encodeScan(nil, bw)
+	bw.flush()
+
+	out := []byte{0xFF, 0xD8}
+	for _, s := range img.extra {
+		out = appendSegment(out, s.marker, s.payload)
+	}
+
+	var dqt []byte
+	for _, q := range img.qt {
+		dqt = append(dqt, q...)
+	}
+	out = appendSegment(out, 0xDB, dqt)
+
+	sof := []byte{8, byte(img.height >> 8), byte(img.height), byte(img.width >> 8), byte(img.width), byte(len(img.comps))}
+	for _, c := range img.comps {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), c.tq)
+	}
+	out = appendSegment(out, img.sof, sof)
+	out = appendSegment(out, 0xC4, dht)
+
+	sos := []byte{byte(len(img.comps))}
+	for _, c := range img.comps {
+		sos = append(sos, c.id, c.td<<4|c.ta)
+	}
+	sos = append(sos, 0, 63, 0)
+	out = appendSegment(out, 0xDA, sos)
+
+	out = append(out, bw.out...)
+	out = append(out, 0xFF, 0xD9)
+	return append(out, img.trailer...)
+}
+
+// Walks the coefficients in scan order, either counting symbols or writing them
+func (img *coeffImage) encodeScan(count func(class, id, sym byte), bw *bitWriter) {
+	emit := func(class, id, sym byte) {
+		if bw == nil {
+			count(class, id, sym)
+			return
+		}
+		t := img.dc[id]
+		if class == 1 {
+			t = img.ac[id]
+		}
+		bw.write(uint32(t.code[sym]), uint(t.size[sym]))
+	}
+	bits := func(v uint32, n byte) {
+		if bw != nil {
+			bw.write(v, uint(n))
+		}
+	}
+
+	preds := make([]int32, len(img.comps))
+	img.eachBlock(img.comps, func(ci, _, i int) error {
+		c := img.comps[ci]
+		blk := &c.blocks[i]
+
+		s, v := magnitude(int32(blk[0]) - preds[ci])
+		preds[ci] = int32(blk[0])
+		emit(0, c.td, s)
+		bits(v, s)
+
+		run := 0
+		for k := 1; k < 64; k++ {
+			coef := blk[zigzag[k]]
+			if coef == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				emit(1, c.ta, 0xF0)
+				run -= 16
+			}
+			s, v := magnitude(int32(coef))
+			emit(1, c.ta, byte(run<<4)|s)
+			bits(v, s)
+			run = 0
+		}
+		if run > 0 {
+			emit(1, c.ta, 0x00)
+		}
+		return nil
+	})
+}
+
+func appendSegment(b []byte, marker byte, payload []byte) []byte {
+	b = append(b, 0xFF, marker)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+2))
+	return append(b, payload...)
+}
@@ -2,274 +2,208 @@ package jpegstrip
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
+	"encoding/hex"
 	"io"
+	"strconv"
 	"strings"
 )
 
-var ErrTruncated = errors.New("truncated or malformed JPEG")
-var ErrNotJPEG = errors.New("not a JPEG (missing SOI)")
-
-func MarkerFor(metaType string) (marker byte, prefix []byte) {
+func MarkerFor(metaType string) ([]Rule, bool) {
 	switch strings.ToLower(strings.TrimSpace(metaType)) {
 	case "exif":
-		return 0xE1, []byte("Exif\x00\x00") // APP1 EXIF
+		return []Rule{{Marker: 0xE1, Prefix: exifPrefix}}, true // APP1 EXIF
 	case "xmp":
-		return 0xE1, []byte("http://ns.adobe.com/xap/1.0/") // APP1 XMP
+		return []Rule{
+			{Marker: 0xE1, Prefix: xmpPrefix},          // APP1 XMP
+			{Marker: 0xE1, Prefix: xmpExtensionPrefix}, // APP1 extended XMP chunks
+		}, true
 	case "icc":
-		return 0xE2, nil // APP2 ICC
+		return []Rule{{Marker: 0xE2, Prefix: iccPrefix}}, true // APP2 ICC, every chunk of the profile
+	case "mpf":
+		return []Rule{{Marker: 0xE2, Prefix: mpfPrefix}}, true // APP2 multi-picture index
+	case "fpxr":
+		return []Rule{{Marker: 0xE2, Prefix: fpxrPrefix}}, true // APP2 FlashPix extension
 	case "comment", "com":
-		return 0xFE, nil // COM
+		return []Rule{{Marker: 0xFE}}, true // COM
+	case "photoshop":
+		return []Rule{{Marker: 0xED, Prefix: photoshopPrefix}}, true // APP13 Photoshop image resources
+	case "jumbf":
+		return []Rule{{Marker: 0xEB, Prefix: jumbfPrefix}}, true // APP11 JUMBF boxes, C2PA among them
 	default:
-		return 0, nil
+		return markerRule(metaType)
+	}
+}
+
+// Parses a raw marker rule: "app12" or "0xEC" for a whole marker, optionally
+// followed by ":prefix=<hex>" to match only payloads starting with those
+// bytes. Only APPn and COM can be named, as the rest is needed to decode.
+func markerRule(s string) ([]Rule, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	name, prefix, hasPrefix := strings.Cut(s, ":prefix=")
+
+	var marker byte
+	if n, ok := strings.CutPrefix(name, "app"); ok {
+		v, err := strconv.ParseUint(n, 10, 8)
+		if err != nil || v > 15 || n != strconv.Itoa(int(v)) {
+			return nil, false
+		}
+		marker = 0xE0 + byte(v)
+	} else if n, ok := strings.CutPrefix(name, "0x"); ok && len(n) == 2 {
+		v, err := strconv.ParseUint(n, 16, 8)
+		if err != nil || !(v >= 0xE0 && v <= 0xEF || v == 0xFE) {
+			return nil, false
+		}
+		marker = byte(v)
+	} else {
+		return nil, false
+	}
+
+	r := Rule{Marker: marker}
+	if hasPrefix {
+		b, err := hex.DecodeString(prefix)
+		if err != nil || len(b) == 0 || len(b) > 64 {
+			return nil, false
+		}
+		r.Prefix = b
 	}
+	return []Rule{r}, true
+}
+
+// Strip copies a JPEG from in to out without the metadata the policy removes.
+// Secondary images listed in an MPF index are cleaned with the same policy.
+func Strip(in io.Reader, out io.Writer, policy *Policy) error {
+	_, err := StripWithRepairs(in, out, policy)
+	return err
 }
 
-func Strip(in io.Reader, out io.Writer, metadataRules map[byte][]byte) error {
-	var hdr [2]byte
-	_, err := io.ReadFull(in, hdr[:])
+// StripWithRepairs is Strip that also returns what was repaired in the input
+// to get through it, as the policy's parse mode allows
+func StripWithRepairs(in io.Reader, out io.Writer, policy *Policy) ([]Repair, error) {
+	limits := policy.limits()
+	data, err := readLimited(in, limits)
 	if err != nil {
-		return ErrTruncated
+		return nil, err
+	}
+
+	b := newBudget(limits)
+	if mp, ok := parseMPF(data, b); ok {
+		return stripMultiPicture(data, mp, out, policy, b)
+	}
+	return stripImage(data, out, policy, b)
+}
+
+func stripImage(data []byte, out io.Writer, policy *Policy, b *budget) ([]Repair, error) {
+	// The canonical layout is built from the stripped image
+	if policy != nil && policy.Layout == LayoutCanonical {
+		p := *policy
+		p.Layout = LayoutKeep
+		var buf bytes.Buffer
+		repairs, err := stripImage(data, &buf, &p, b)
+		if err != nil {
+			return nil, err
+		}
+		return repairs, rebuild(buf.Bytes(), out)
 	}
 
-	if hdr[0] != 0xFF || hdr[1] != 0xD8 {
-		return ErrNotJPEG
+	keepOrientation := policy != nil && policy.Orientation == OrientationKeep
+	if policy != nil && policy.Orientation == OrientationBake {
+		baked, ok := bakeOrientation(data, b.Limits)
+		data, keepOrientation = baked, !ok
+	}
+
+	sr := newSegmentReader(bytes.NewReader(data))
+	sr.mode, sr.budget = policy.parseMode(), b
+	err := sr.readSOI()
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = out.Write(hdr[:])
+	_, err = out.Write([]byte{0xFF, 0xD8})
 	if err != nil {
-		return err
+		return nil, writeFailed(segment{marker: 0xD8}, err)
 	}
 
+	jumbf := jumbfInstances(data) // JUMBF box labels by instance
+	var photoshop []segment       // APP13 segments waiting for the rest of their resources
+
 	for {
-		marker, err := readMarkerByte(in)
+		seg, err := sr.next()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return ErrTruncated
+			return nil, err
+		}
+
+		if seg.marker == 0xED && bytes.HasPrefix(seg.payload, photoshopPrefix) {
+			photoshop = append(photoshop, seg)
+			continue
+		}
+		if photoshop != nil {
+			if err := writePhotoshop(out, photoshop, policy); err != nil {
+				return nil, err
 			}
-			return err
+			photoshop = nil
 		}
 
-		switch marker {
+		switch seg.marker {
 		case 0xD9: // EOI (End of Image)
-			_, err = out.Write([]byte{0xFF, 0xD9})
+			err = seg.writeTo(out)
 			if err != nil {
-				return err
+				return nil, writeFailed(seg, err)
 			}
 
-			return nil
+			// Anything after EOI is not part of the image
+			if policy != nil && policy.Trailer == TrailerDrop {
+				return sr.repairs, nil
+			}
+			_, err = io.Copy(out, sr)
+			return sr.repairs, writeFailed(segment{offset: sr.off}, err)
 
 		case 0xDA: // SOS (Start of Scan)
-			// Copy segment + length + header
-			err = copySegmentWithLength(in, out, marker)
+			err = seg.writeTo(out)
 			if err != nil {
-				return err
-			}
-
-			// Copy the rest of the file and keep the last 2 bytes values
-			var lastBytes [2]byte
-			buf := make([]byte, 32*1024)
-			for {
-				n, err := in.Read(buf)
-
-				if n > 0 {
-					if n == 1 {
-						lastBytes[0], lastBytes[1] = lastBytes[1], buf[0]
-					} else {
-						lastBytes[0] = buf[n-2]
-						lastBytes[1] = buf[n-1]
-					}
-					_, writeErr := out.Write(buf[:n])
-					if writeErr != nil {
-						return writeErr
-					}
-				}
-
-				if err == io.EOF {
-					break
-				}
-
-				if err != nil {
-					return err
-				}
+				return nil, writeFailed(seg, err)
 			}
 
-			if !(lastBytes[0] == 0xFF && lastBytes[1] == 0xD9) {
-				return ErrTruncated
+			// Progressive and multi-scan images carry more tables, scans and
+			// even metadata segments after the first scan
+			err = sr.copyEntropy(out)
+			if err != nil {
+				return nil, err
 			}
 
-			return nil
-
 		default:
-			prefix, ok := metadataRules[marker]
-			if ok {
-				if len(prefix) == 0 {
-					if err := dropSegmentWithLength(in); err != nil {
-						return err
-					}
-					continue
+			if seg.payload == nil {
+				err = seg.writeTo(out)
+				if err != nil {
+					return nil, writeFailed(seg, err)
 				}
 
-				if err := dropSegmentByPrefix(in, out, marker, prefix); err != nil {
-					return err
-				}
+				continue
+			}
 
+			// Packets of a JUMBF box are dropped along with the first one
+			if policy.dropsJUMBF(seg.marker, seg.payload, jumbf) {
 				continue
 			}
 
-			if isNoLengthMarker(marker) {
-				_, err := out.Write([]byte{0xFF, marker})
-				if err != nil {
-					return err
+			kept, keep := policy.apply(seg.marker, seg.payload)
+			if !keep {
+				// Only the first EXIF segment counts, the same as for readers
+				if keepOrientation && seg.marker == 0xE1 && bytes.HasPrefix(seg.payload, exifPrefix) {
+					keepOrientation = false
+					if o := exifOrientation(seg.payload); o > 1 {
+						err = writeSegment(out, 0xE1, orientationExif(o))
+						if err != nil {
+							return nil, writeFailed(seg, err)
+						}
+					}
 				}
-
 				continue
 			}
 
-			err = copySegmentWithLength(in, out, marker)
+			err = writeSegment(out, seg.marker, kept)
 			if err != nil {
-				return err
+				return nil, writeFailed(seg, err)
 			}
 		}
 	}
 }
-
-func readMarkerByte(r io.Reader) (byte, error) {
-	var b [1]byte
-	for {
-		_, err := io.ReadFull(r, b[:])
-		if err != nil {
-			return 0, err
-		}
-
-		if b[0] == 0xFF {
-			break
-		}
-	}
-
-	for {
-		_, err := io.ReadFull(r, b[:])
-		if err != nil {
-			return 0, err
-		}
-
-		if b[0] != 0xFF {
-			return b[0], nil
-		}
-	}
-}
-
-func copySegmentWithLength(in io.Reader, out io.Writer, marker byte) error {
-	_, err := out.Write([]byte{0xFF, marker})
-	if err != nil {
-		return err
-	}
-
-	var lengthBuf [2]byte
-	_, err = io.ReadFull(in, lengthBuf[:])
-	if err != nil {
-		return ErrTruncated
-	}
-
-	_, err = out.Write(lengthBuf[:])
-	if err != nil {
-		return err
-	}
-
-	length := binary.BigEndian.Uint16(lengthBuf[:])
-	if length < 2 {
-		return ErrTruncated
-	}
-
-	dataLen := length - 2
-
-	_, err = io.CopyN(out, in, int64(dataLen))
-	if err != nil {
-		return ErrTruncated
-	}
-
-	return nil
-}
-
-func dropSegmentWithLength(in io.Reader) error {
-	var lengthBuf [2]byte
-	_, err := io.ReadFull(in, lengthBuf[:])
-	if err != nil {
-		return ErrTruncated
-	}
-
-	length := binary.BigEndian.Uint16(lengthBuf[:])
-	if length < 2 {
-		return ErrTruncated
-	}
-
-	dataLen := length - 2
-	_, err = io.CopyN(io.Discard, in, int64(dataLen))
-	if err != nil {
-		return ErrTruncated
-	}
-
-	return nil
-}
-
-func isNoLengthMarker(marker byte) bool {
-	// SOI D8, EOI D9, RST0-7 D0–D7, TEM 01
-	if marker == 0xD8 || marker == 0xD9 || marker == 0x01 {
-		return true
-	}
-	if marker >= 0xD0 && marker <= 0xD7 {
-		return true
-	}
-	return false
-}
-
-// Reads one segment and drops it only if the payload begins with the given prefix
-func dropSegmentByPrefix(in io.Reader, out io.Writer, marker byte, dropPrefix []byte) error {
-	var lengthBuf [2]byte
-	if _, err := io.ReadFull(in, lengthBuf[:]); err != nil {
-		return ErrTruncated
-	}
-
-	length := binary.BigEndian.Uint16(lengthBuf[:])
-	if length < 2 {
-		return ErrTruncated
-	}
-
-	payloadLen := int64(length - 2)
-
-	// Read up to len(dropPrefix) bytes for prefix comparison
-	toPeek := int64(len(dropPrefix))
-	if toPeek > payloadLen {
-		toPeek = payloadLen
-	}
-
-	peek := make([]byte, toPeek)
-	if _, err := io.ReadFull(in, peek); err != nil {
-		return ErrTruncated
-	}
-
-	// Drop only if full prefix matches
-	if toPeek == int64(len(dropPrefix)) && bytes.Equal(peek, dropPrefix) {
-		// Discard the rest of the payload
-		if _, err := io.CopyN(io.Discard, in, payloadLen-toPeek); err != nil {
-			return ErrTruncated
-		}
-		return nil
-	}
-
-	// Not a match -> copy entire segment: marker, length, peek, remainder
-	if _, err := out.Write([]byte{0xFF, marker}); err != nil {
-		return err
-	}
-	if _, err := out.Write(lengthBuf[:]); err != nil {
-		return err
-	}
-	if _, err := out.Write(peek); err != nil {
-		return err
-	}
-	if _, err := io.CopyN(out, in, payloadLen-toPeek); err != nil {
-		return ErrTruncated
-	}
-	return nil
-}
@@ -9,22 +9,19 @@ import (
 	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
 )
 
-// helper: build rules map from meta type names ("exif", "xmp", "icc", "com", ...)
-func rulesFor(types ...string) map[byte][]byte {
-	m := make(map[byte][]byte, len(types))
+// helper: build a policy from meta type names ("exif", "xmp", "icc", "com", ...)
+func policyFor(types ...string) *Policy {
+	p := NewPolicy()
 	for _, t := range types {
-		marker, prefix := MarkerFor(t)
-		if marker != 0 {
-			m[marker] = prefix
-		}
+		p.AddType(t)
 	}
-	return m
+	return p
 }
 
 func TestStripValidImage(t *testing.T) {
 	t.Run("Removes APP1 (EXIF)", func(t *testing.T) {
 		r, out, _ := makeFullTestJPEG()
-		rules := rulesFor("exif")
+		rules := policyFor("exif")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -42,7 +39,7 @@ func TestStripValidImage(t *testing.T) {
 
 	t.Run("Removes ICC from valid JPEG", func(t *testing.T) {
 		r, out, _ := makeFullTestJPEG()
-		rules := rulesFor("icc")
+		rules := policyFor("icc")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -57,7 +54,7 @@ func TestStripValidImage(t *testing.T) {
 
 	t.Run("Removes XMP from valid JPEG", func(t *testing.T) {
 		r, out, _ := makeFullTestJPEG()
-		rules := rulesFor("xmp")
+		rules := policyFor("xmp")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -72,7 +69,7 @@ func TestStripValidImage(t *testing.T) {
 
 	t.Run("Removes COM from valid JPEG", func(t *testing.T) {
 		r, out, _ := makeFullTestJPEG()
-		rules := rulesFor("com")
+		rules := policyFor("com")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -87,7 +84,7 @@ func TestStripValidImage(t *testing.T) {
 
 	t.Run("Removes EXIF and ICC when both selected", func(t *testing.T) {
 		r, out, _ := makeFullTestJPEG()
-		rules := rulesFor("exif", "icc")
+		rules := policyFor("exif", "icc")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -109,9 +106,30 @@ func TestStripValidImage(t *testing.T) {
 		}
 	})
 
+	t.Run("Removes EXIF and XMP when both selected", func(t *testing.T) {
+		r, out, _ := makeFullTestJPEG()
+		rules := policyFor("exif", "xmp")
+
+		err := Strip(r, out, rules)
+		if err != nil {
+			t.Fatalf("Strip() unexpected error: %v", err)
+		}
+		got := out.Bytes()
+
+		if bytes.Contains(got, []byte("Exif\x00\x00")) {
+			t.Fatalf("APP1 (EXIF) not removed when EXIF+XMP selected")
+		}
+		if bytes.Contains(got, []byte("http://ns.adobe.com/xap/1.0/")) {
+			t.Fatalf("APP1 (XMP) not removed when EXIF+XMP selected")
+		}
+		if !testutil.ContainsMarker(got, 0xE2) {
+			t.Fatalf("expected ICC (APP2) to be preserved when EXIF+XMP selected")
+		}
+	})
+
 	t.Run("Removes EXIF, ICC and COM when selected", func(t *testing.T) {
 		r, out, _ := makeFullTestJPEG()
-		rules := rulesFor("exif", "icc", "com")
+		rules := policyFor("exif", "icc", "com")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -142,7 +160,7 @@ func TestStripValidImage(t *testing.T) {
 
 	t.Run("Preserves JPEG structure", func(t *testing.T) {
 		r, out, _ := makeFullTestJPEG()
-		rules := rulesFor("exif")
+		rules := policyFor("exif")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -163,7 +181,7 @@ func TestStripValidImage(t *testing.T) {
 
 	t.Run("Output is smaller", func(t *testing.T) {
 		r, out, img := makeFullTestJPEG()
-		rules := rulesFor("exif")
+		rules := policyFor("exif")
 
 		err := Strip(r, out, rules)
 		if err != nil {
@@ -177,8 +195,261 @@ func TestStripValidImage(t *testing.T) {
 	})
 }
 
+func TestPolicy(t *testing.T) {
+	t.Run("Prefix rules on the same marker accumulate", func(t *testing.T) {
+		p := NewPolicy(
+			Rule{Marker: 0xE1, Prefix: []byte("Exif\x00\x00")},
+			Rule{Marker: 0xE1, Prefix: []byte("http://ns.adobe.com/xap/1.0/")},
+		)
+
+		if !p.Drops(0xE1, []byte("Exif\x00\x00data")) {
+			t.Fatalf("expected EXIF payload to be dropped")
+		}
+		if !p.Drops(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")) {
+			t.Fatalf("expected XMP payload to be dropped")
+		}
+		if p.Drops(0xE1, []byte("Other\x00")) {
+			t.Fatalf("unexpected drop of unmatched APP1 payload")
+		}
+	})
+
+	t.Run("Whole marker rule wins over prefix rules", func(t *testing.T) {
+		p := NewPolicy(
+			Rule{Marker: 0xE2, Prefix: []byte("ICC_PROFILE\x00")},
+			Rule{Marker: 0xE2},
+		)
+
+		if !p.Drops(0xE2, []byte("MPF\x00")) {
+			t.Fatalf("expected every APP2 payload to be dropped")
+		}
+	})
+
+	t.Run("Prefix longer than payload does not match", func(t *testing.T) {
+		p := NewPolicy(Rule{Marker: 0xE1, Prefix: []byte("Exif\x00\x00")})
+
+		if p.Drops(0xE1, []byte("Exif")) {
+			t.Fatalf("unexpected drop of short payload")
+		}
+	})
+
+	t.Run("Nil policy drops nothing", func(t *testing.T) {
+		var p *Policy
+		if p.Drops(0xFE, []byte("comment")) {
+			t.Fatalf("nil policy must not drop segments")
+		}
+	})
+
+	t.Run("Zero policy can be filled in", func(t *testing.T) {
+		p := &Policy{}
+		p.Add(Rule{Marker: 0xFE})
+		p.DropResources(ResourceIPTC)
+		p.RemoveExifTags(ExifTag{IFD: ExifIFD, Tag: 0x9291})
+		p.RemoveXMP(XMPHistory)
+		p.DropJUMBF("c2pa")
+
+		got := stripBytes(t, makeDatedImage(), p)
+		if bytes.Contains(got, []byte("20240501")) {
+			t.Fatalf("expected the IPTC record to be removed")
+		}
+		if !p.Drops(0xFE, []byte("comment")) {
+			t.Fatalf("expected comments to be dropped")
+		}
+	})
+
+	t.Run("AddType rejects unknown names", func(t *testing.T) {
+		p := NewPolicy()
+		if p.AddType("nope") {
+			t.Fatalf("expected unknown type to be rejected")
+		}
+		if !p.AddType(" EXIF ") {
+			t.Fatalf("expected EXIF to be accepted")
+		}
+	})
+}
+
+func TestAPP2Types(t *testing.T) {
+	icc1 := testutil.MakeSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x02first half"))
+	icc2 := testutil.MakeSegment(0xE2, []byte("ICC_PROFILE\x00\x02\x02second half"))
+	mpf := testutil.MakeSegment(0xE2, []byte("MPF\x00II*\x00"))
+	fpxr := testutil.MakeSegment(0xE2, []byte("FPXR\x00\x00\x01"))
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+	img := testutil.MakeJPEG(icc1, mpf, icc2, fpxr, sos)
+
+	cases := []struct {
+		metaType string
+		want     []byte
+	}{
+		{"icc", testutil.MakeJPEG(mpf, fpxr, sos)},
+		{"mpf", testutil.MakeJPEG(icc1, icc2, fpxr, sos)},
+		{"fpxr", testutil.MakeJPEG(icc1, mpf, icc2, sos)},
+	}
+
+	for _, c := range cases {
+		t.Run("Removes only "+c.metaType, func(t *testing.T) {
+			if got := stripBytes(t, img, policyFor(c.metaType)); !bytes.Equal(got, c.want) {
+				t.Fatalf("unexpected output\n got %X\nwant %X", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMarkerRules(t *testing.T) {
+	ducky := testutil.MakeSegment(0xEC, []byte("Ducky\x00\x01\x00\x04\x00\x00\x00\x50"))
+	samsung := testutil.MakeSegment(0xE4, []byte("SEC vendor data"))
+	exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00MM"))
+	other := testutil.MakeSegment(0xE1, []byte("Other\x00"))
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+	img := testutil.MakeJPEG(ducky, samsung, exif, other, sos)
+
+	cases := []struct {
+		metaType string
+		want     []byte
+	}{
+		{"app12", testutil.MakeJPEG(samsung, exif, other, sos)},
+		{"APP4", testutil.MakeJPEG(ducky, exif, other, sos)},
+		{"0xEC", testutil.MakeJPEG(samsung, exif, other, sos)},
+		{"app1:prefix=4f74686572", testutil.MakeJPEG(ducky, samsung, exif, sos)},
+		{"0xe1:prefix=457869660000", testutil.MakeJPEG(ducky, samsung, other, sos)},
+	}
+
+	for _, c := range cases {
+		t.Run("Removes "+c.metaType, func(t *testing.T) {
+			if got := stripBytes(t, img, policyFor(c.metaType)); !bytes.Equal(got, c.want) {
+				t.Fatalf("unexpected output\n got %X\nwant %X", got, c.want)
+			}
+		})
+	}
+
+	t.Run("Rejects invalid rules", func(t *testing.T) {
+		for _, v := range []string{
+			"app16", "app", "app01", "app-1", "0xDB", "0xD9", "0xC0", "0xDA", "0xE", "0x1EC", "ec",
+			"app1:prefix=", "app1:prefix=abc", "app1:prefix=zz", "app1:suffix=00",
+		} {
+			if NewPolicy().AddType(v) {
+				t.Fatalf("expected %q to be rejected", v)
+			}
+		}
+	})
+
+	t.Run("COM can be named by number", func(t *testing.T) {
+		rules, ok := MarkerFor("0xFE")
+		if !ok || len(rules) != 1 || rules[0].Marker != 0xFE || rules[0].Prefix != nil {
+			t.Fatalf("unexpected rules %+v", rules)
+		}
+	})
+}
+
+func TestAllowlist(t *testing.T) {
+	jfif := testutil.MakeSegment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00data"))
+	icc := testutil.MakeSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	mpf := testutil.MakeSegment(0xE2, []byte("MPF\x00II*\x00"))
+	vendor := testutil.MakeSegment(0xE7, []byte("never heard of it"))
+	com := testutil.MakeSegment(0xFE, []byte("comment"))
+	dqt := testutil.MakeSegment(0xDB, append([]byte{0x00}, make([]byte, 64)...))
+	sof := testutil.MakeSegment(0xC0, []byte{8, 0, 16, 0, 16, 1, 1, 0x11, 0})
+	dri := testutil.MakeSegment(0xDD, []byte{0x00, 0x04})
+	sos := testutil.MakeSOS([]byte{0x11, 0xFF, 0xD0, 0x22})
+	adobe := func(transform byte) []byte {
+		return testutil.MakeSegment(0xEE, []byte{'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, transform})
+	}
+
+	t.Run("Keeps only what is needed to decode", func(t *testing.T) {
+		img := testutil.MakeJPEG(jfif, exif, icc, mpf, vendor, com, dqt, sof, dri, sos)
+		got := stripBytes(t, append(img, "trailer"...), policyFor("all"))
+
+		want := testutil.MakeJPEG(dqt, sof, dri, sos)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("unexpected output\n got %X\nwant %X", got, want)
+		}
+	})
+
+	t.Run("JFIF and ICC can be kept", func(t *testing.T) {
+		p := policyFor("all")
+		p.KeepJFIF, p.KeepICC = true, true
+		got := stripBytes(t, testutil.MakeJPEG(jfif, exif, icc, mpf, sof, sos), p)
+
+		want := testutil.MakeJPEG(jfif, icc, sof, sos)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("unexpected output\n got %X\nwant %X", got, want)
+		}
+	})
+
+	t.Run("Adobe segment stays when it changes the colour transform", func(t *testing.T) {
+		for transform, keep := range map[byte]bool{0: true, 1: false, 2: true} {
+			got := stripBytes(t, testutil.MakeJPEG(adobe(transform), sof, sos), policyFor("all"))
+
+			if testutil.ContainsMarker(got, 0xEE) != keep {
+				t.Fatalf("transform %d: expected kept=%v", transform, keep)
+			}
+		}
+	})
+
+	t.Run("Orientation can still be kept", func(t *testing.T) {
+		exif := testutil.MakeSegment(0xE1, testutil.Exif{IFD0: []testutil.Tag{testutil.Short(0x0112, 3)}}.Payload())
+
+		p := policyFor("all")
+		p.Orientation = OrientationKeep
+		got := stripBytes(t, testutil.MakeJPEG(exif, sof, sos), p)
+
+		if !bytes.Contains(got, orientationExif(3)) {
+			t.Fatalf("expected minimal orientation EXIF")
+		}
+	})
+}
+
+func TestStripMultiScan(t *testing.T) {
+	dht := testutil.MakeSegment(0xC4, []byte{0x00, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x05})
+	com := testutil.MakeSegment(0xFE, []byte("between scans"))
+	exif := testutil.MakeSegment(0xE1, []byte("Exif\x00\x00late"))
+
+	// Scan data with stuffed bytes and restart markers that must not be
+	// mistaken for segments
+	scan1 := []byte{0x11, 0xFF, 0x00, 0x22, 0xFF, 0xD0, 0x33, 0xFF, 0xD1, 0x44}
+	scan2 := []byte{0x55, 0xFF, 0x00, 0xFF, 0xD2, 0x66}
+
+	sos1 := testutil.MakeSOS(scan1)
+	sos2 := testutil.MakeSOS(scan2)
+	img := testutil.MakeJPEG(sos1, dht, com, exif, sos2)
+
+	t.Run("Metadata between scans is removed", func(t *testing.T) {
+		got := stripBytes(t, img, policyFor("comment", "exif"))
+
+		want := testutil.MakeJPEG(sos1, dht, sos2)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("unexpected output\n got %X\nwant %X", got, want)
+		}
+	})
+
+	t.Run("Nothing selected copies the file", func(t *testing.T) {
+		if got := stripBytes(t, img, NewPolicy()); !bytes.Equal(got, img) {
+			t.Fatalf("expected image to be unchanged")
+		}
+	})
+
+	t.Run("Fill bytes in front of a marker are dropped", func(t *testing.T) {
+		filled := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11, 0xFF, 0xFF}), com, sos2)
+
+		got := stripBytes(t, filled, policyFor("comment"))
+
+		want := testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11}), sos2)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("unexpected output\n got %X\nwant %X", got, want)
+		}
+	})
+
+	t.Run("Bytes after EOI are copied", func(t *testing.T) {
+		trailing := append(append([]byte{}, img...), "trailer"...)
+
+		got := stripBytes(t, trailing, policyFor("comment"))
+		if !bytes.HasSuffix(got, []byte("\xFF\xD9trailer")) {
+			t.Fatalf("expected trailing bytes to be kept")
+		}
+	})
+}
+
 func TestStripInvalidImage(t *testing.T) {
-	rules := rulesFor("exif")
+	rules := policyFor("exif")
 
 	// Not a JPEG (missing SOI)
 	t.Run("NotJPEG missing SOI", func(t *testing.T) {
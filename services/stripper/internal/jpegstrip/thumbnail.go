@@ -0,0 +1,205 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/bits"
+)
+
+const tagThumbnailOffset = 0x0201 // JPEGInterchangeFormat
+
+// Thumbnail describes the JPEG thumbnail in EXIF IFD1 and whether it still
+// shows the same picture as the main image. A thumbnail that doesn't usually
+// shows the photo from before it was cropped or edited.
+type Thumbnail struct {
+	Width           int  `json:"width"`
+	Height          int  `json:"height"`
+	Length          int  `json:"length"`
+	AspectMismatch  bool `json:"aspectMismatch"`
+	ContentMismatch bool `json:"contentMismatch"`
+}
+
+// Bits out of 64 that may differ between two average hashes of the same
+// picture, to allow for the loss in the thumbnail
+const maxHashDistance = 12
+
+// Rewrites an APP1 EXIF payload without IFD1 and the thumbnail it points at.
+// A payload that cannot be parsed is dropped as a whole.
+func removeThumbnail(payload []byte) ([]byte, bool) {
+	t, err := parseTIFF(payload[len(exifPrefix):])
+	if err != nil {
+		return nil, false
+	}
+	if t.ifd1 == nil {
+		return payload, true
+	}
+
+	t.ifd1 = nil
+	return append(append([]byte{}, exifPrefix...), t.encode()...), true
+}
+
+// Returns the JPEG thumbnail of an APP1 EXIF payload, or nil
+func exifThumbnail(payload []byte) []byte {
+	t, err := parseTIFF(payload[len(exifPrefix):])
+	if err != nil {
+		return nil
+	}
+	e := t.ifd(IFD1).find(tagThumbnailOffset)
+	if e == nil || len(e.blobs) != 1 {
+		return nil
+	}
+	return e.blobs[0]
+}
+
+// Compares a thumbnail with the main image, given as the whole file and its
+// frame size. The content is only compared when both decode, the main image
+// at an eighth of its size, which leaves out progressive main images.
+func checkThumbnail(thumb, file []byte, width, height int, limits Limits) *Thumbnail {
+	info := &Thumbnail{Length: len(thumb)}
+
+	small, err := decodeBounded(thumb, limits)
+	if err != nil {
+		return info
+	}
+	info.Width, info.Height = small.Bounds().Dx(), small.Bounds().Dy()
+
+	// Cameras letterbox thumbnails to a fixed size, so only the content
+	// inside the black bars counts
+	content := contentBounds(small)
+	if width > 0 && height > 0 && content.Dx() > 0 && content.Dy() > 0 {
+		want := float64(width) / float64(height)
+		got := float64(content.Dx()) / float64(content.Dy())
+		// A pixel of rounding on either side is not a mismatch
+		tolerance := math.Max(0.05, 2/float64(min(content.Dx(), content.Dy())))
+		info.AspectMismatch = math.Abs(math.Log(got/want)) > tolerance
+	}
+
+	if info.AspectMismatch {
+		return info
+	}
+	main, err := decodePreview(file, limits)
+	if err != nil {
+		return info
+	}
+	d := bits.OnesCount64(averageHash(small, content) ^ averageHash(main, main.Bounds()))
+	info.ContentMismatch = d > maxHashDistance
+	return info
+}
+
+// Decodes a JPEG unless its frame is too big to decode or for the data to
+// code, as the decoder allocates the whole frame up front
+func decodeBounded(data []byte, limits Limits) (image.Image, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if !limits.decodable(cfg.Width, cfg.Height, len(data)) {
+		return nil, ErrLimitExceeded
+	}
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+// Decodes the luma of a sequential JPEG at one pixel per block, the average
+// the DC coefficient gives. It costs a pass over the scans but no more
+// memory than a small image, whatever the frame size.
+func decodePreview(data []byte, limits Limits) (*image.Gray, error) {
+	img, err := decodeFrame(data, limits, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c := img.comps[0]
+	q := img.qt[c.tq]
+	if q == nil {
+		return nil, errUnsupportedTransform
+	}
+	step := int(q[1])
+	if q[0]>>4 != 0 {
+		step = int(binary.BigEndian.Uint16(q[1:]))
+	}
+
+	w := ceilDiv(ceilDiv(img.width*c.h, img.hmax), 8)
+	h := ceilDiv(ceilDiv(img.height*c.v, img.vmax), 8)
+	preview := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := int(c.dc[y*c.bw+x])*step/8 + 128
+			preview.Pix[y*preview.Stride+x] = uint8(max(0, min(255, v)))
+		}
+	}
+	return preview, nil
+}
+
+// Returns the bounds of an image without the near black rows and columns
+// along its edges
+func contentBounds(img image.Image) image.Rectangle {
+	r := img.Bounds()
+	dark := func(x0, y0, x1, y1 int) bool {
+		var sum, n int
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				sum += int(luma(img, x, y))
+				n++
+			}
+		}
+		return n > 0 && sum <= 16*n
+	}
+
+	for r.Dy() > 1 && dark(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1) {
+		r.Min.Y++
+	}
+	for r.Dy() > 1 && dark(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y) {
+		r.Max.Y--
+	}
+	for r.Dx() > 1 && dark(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y) {
+		r.Min.X++
+	}
+	for r.Dx() > 1 && dark(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y) {
+		r.Max.X--
+	}
+	return r
+}
+
+// Returns a 64 bit hash of the part r of an image, one bit per cell of an
+// 8x8 grid telling whether the cell is brighter than the whole
+func averageHash(img image.Image, r image.Rectangle) uint64 {
+	const grid, samples = 8, 8
+
+	var cells [grid * grid]float64
+	var total float64
+	for i := range cells {
+		cx, cy := i%grid, i/grid
+		var sum float64
+		for sy := range samples {
+			for sx := range samples {
+				x := r.Min.X + (cx*samples+sx)*r.Dx()/(grid*samples)
+				y := r.Min.Y + (cy*samples+sy)*r.Dy()/(grid*samples)
+				sum += float64(luma(img, x, y))
+			}
+		}
+		cells[i] = sum / (samples * samples)
+		total += cells[i]
+	}
+
+	var hash uint64
+	for i, c := range cells {
+		if c > total/(grid*grid) {
+			hash |= 1 << i
+		}
+	}
+	return hash
+}
+
+func luma(img image.Image, x, y int) uint8 {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return img.Y[img.YOffset(x, y)]
+	case *image.Gray:
+		return img.Pix[img.PixOffset(x, y)]
+	}
+	return color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+}
@@ -0,0 +1,161 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+// helper: encode a w x h picture of a bright disc on a gradient, drawn inside
+// r of the frame and black outside it
+func makePicture(t *testing.T, w, h int, r image.Rectangle, invert bool) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			u := float64(x-r.Min.X) / float64(r.Dx())
+			v := float64(y-r.Min.Y) / float64(r.Dy())
+			g := 40 + 120*u
+			if (u-0.3)*(u-0.3)+(v-0.6)*(v-0.6) < 0.05 {
+				g = 250
+			}
+			if invert {
+				g = 255 - g
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(g)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// helper: put an EXIF block with the given thumbnail into an encoded JPEG
+func withThumbnail(img, thumb []byte) []byte {
+	exif := testutil.Exif{
+		IFD0:      []testutil.Tag{testutil.ASCII(0x010F, "ACME")},
+		Thumbnail: thumb,
+	}
+	seg := testutil.MakeSegment(0xE1, exif.Payload())
+	return append(append(append([]byte{}, img[:2]...), seg...), img[2:]...)
+}
+
+func TestThumbnail(t *testing.T) {
+	main := makePicture(t, 320, 240, image.Rect(0, 0, 320, 240), false)
+
+	inspect := func(t *testing.T, thumb []byte) *Thumbnail {
+		t.Helper()
+		report, err := Inspect(bytes.NewReader(withThumbnail(main, thumb)))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		if report.Thumbnail == nil {
+			t.Fatalf("expected a thumbnail in the report")
+		}
+		return report.Thumbnail
+	}
+
+	t.Run("Matching thumbnail", func(t *testing.T) {
+		got := inspect(t, makePicture(t, 160, 120, image.Rect(0, 0, 160, 120), false))
+		if got.Width != 160 || got.Height != 120 || got.AspectMismatch || got.ContentMismatch {
+			t.Fatalf("unexpected %+v", got)
+		}
+	})
+
+	t.Run("Letterboxed thumbnail", func(t *testing.T) {
+		got := inspect(t, makePicture(t, 160, 160, image.Rect(0, 20, 160, 140), false))
+		if got.AspectMismatch || got.ContentMismatch {
+			t.Fatalf("unexpected %+v", got)
+		}
+	})
+
+	t.Run("Different aspect ratio", func(t *testing.T) {
+		got := inspect(t, makePicture(t, 160, 90, image.Rect(0, 0, 160, 90), false))
+		if !got.AspectMismatch {
+			t.Fatalf("expected an aspect mismatch, got %+v", got)
+		}
+	})
+
+	t.Run("Different content", func(t *testing.T) {
+		got := inspect(t, makePicture(t, 160, 120, image.Rect(0, 0, 160, 120), true))
+		if got.AspectMismatch || !got.ContentMismatch {
+			t.Fatalf("expected a content mismatch, got %+v", got)
+		}
+	})
+
+	t.Run("Frame too big for the file is not decoded", func(t *testing.T) {
+		big := makePicture(t, 32, 24, image.Rect(0, 0, 32, 24), false)
+		sof := bytes.Index(big, []byte{0xFF, 0xC0})
+		binary.BigEndian.PutUint16(big[sof+5:], 12000)
+		binary.BigEndian.PutUint16(big[sof+7:], 16000)
+
+		if _, err := decodeBounded(big, DefaultLimits); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("expected ErrLimitExceeded, got %v", err)
+		}
+
+		thumb := makePicture(t, 160, 120, image.Rect(0, 0, 160, 120), false)
+		report, err := Inspect(bytes.NewReader(withThumbnail(big, thumb)))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		if got := report.Thumbnail; got == nil || got.Width != 160 || got.AspectMismatch || got.ContentMismatch {
+			t.Fatalf("unexpected %+v", got)
+		}
+	})
+
+	t.Run("Main image is compared at one pixel per block", func(t *testing.T) {
+		preview, err := decodePreview(main, DefaultLimits)
+		if err != nil {
+			t.Fatalf("decodePreview: %v", err)
+		}
+		if b := preview.Bounds(); b.Dx() != 40 || b.Dy() != 30 {
+			t.Fatalf("expected a 40x30 preview, got %v", b)
+		}
+
+		full := decodeJPEG(t, main)
+		for _, p := range []image.Point{{12, 18}, {2, 2}, {37, 27}} {
+			var sum int
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					sum += int(luma(full, 8*p.X+x, 8*p.Y+y))
+				}
+			}
+			if got, want := int(preview.GrayAt(p.X, p.Y).Y), sum/64; got < want-2 || got > want+2 {
+				t.Fatalf("block %v: preview %d, average %d", p, got, want)
+			}
+		}
+	})
+
+	t.Run("Undecodable thumbnail is still reported", func(t *testing.T) {
+		got := inspect(t, []byte{0xFF, 0xD8, 0xFF, 0xD9})
+		if got.Length != 4 || got.AspectMismatch || got.ContentMismatch {
+			t.Fatalf("unexpected %+v", got)
+		}
+	})
+
+	t.Run("thumbnail removes IFD1 only", func(t *testing.T) {
+		thumb := makePicture(t, 160, 120, image.Rect(0, 0, 160, 120), false)
+		got := stripBytes(t, withThumbnail(main, thumb), policyFor("thumbnail"))
+
+		tf := mustParseExif(t, got[bytes.Index(got, exifPrefix):])
+		if tf.ifd1 != nil || bytes.Contains(got, thumb) {
+			t.Fatalf("expected the thumbnail to be removed")
+		}
+		if tf.ifd0.find(0x010F).str() != "ACME" {
+			t.Fatalf("expected IFD0 to be kept")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+			t.Fatalf("output does not decode: %v", err)
+		}
+	})
+}
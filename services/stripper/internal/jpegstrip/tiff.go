@@ -0,0 +1,416 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var errBadTIFF = errors.New("malformed TIFF structure")
+
+// IFD identifies one of the image file directories found in an EXIF block
+type IFD int
+
+const (
+	IFD0 IFD = iota
+	ExifIFD
+	GPSIFD
+	InteropIFD
+	IFD1
+)
+
+// TIFF field types
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeSByte     = 6
+	typeUndefined = 7
+	typeSShort    = 8
+	typeSLong     = 9
+	typeSRational = 10
+	typeFloat     = 11
+	typeDouble    = 12
+	typeIFD       = 13
+)
+
+// Tags that point at other IFDs
+const (
+	tagExifIFD    = 0x8769
+	tagGPSIFD     = 0x8825
+	tagInteropIFD = 0xA005
+)
+
+// Tags whose values are offsets to data blocks, paired with the tags holding the block sizes
+var dataPointers = map[uint16]uint16{
+	0x0201: 0x0202, // JPEGInterchangeFormat, JPEGInterchangeFormatLength
+	0x0111: 0x0117, // StripOffsets, StripByteCounts
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // raw value bytes in the byte order of the file
+
+	pos    int      // position of the entry in the parsed block
+	offset uint32   // original value offset, used to keep maker notes in place
+	sub    *tiffIFD // directory referenced by a pointer tag
+	blobs  [][]byte // data blocks referenced by a data pointer tag
+}
+
+type tiffIFD struct {
+	kind    IFD
+	entries []*tiffEntry
+}
+
+type tiffFile struct {
+	order binary.ByteOrder
+	ifd0  *tiffIFD
+	ifd1  *tiffIFD
+}
+
+func typeSize(typ uint16) int {
+	switch typ {
+	case typeByte, typeASCII, typeSByte, typeUndefined:
+		return 1
+	case typeShort, typeSShort:
+		return 2
+	case typeLong, typeSLong, typeFloat, typeIFD:
+		return 4
+	case typeRational, typeSRational, typeDouble:
+		return 8
+	default:
+		return 0
+	}
+}
+
+func parseTIFF(b []byte) (*tiffFile, error) {
+	if len(b) < 8 {
+		return nil, errBadTIFF
+	}
+
+	t := &tiffFile{}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errBadTIFF
+	}
+
+	if t.order.Uint16(b[2:]) != 42 {
+		return nil, errBadTIFF
+	}
+
+	p := &tiffParser{b: b, order: t.order, seen: make(map[uint32]bool)}
+
+	var next uint32
+	var err error
+	t.ifd0, next, err = p.parseIFD(t.order.Uint32(b[4:]), IFD0)
+	if err != nil {
+		return nil, err
+	}
+
+	// A broken link to IFD1 only loses the thumbnail, so it isn't fatal
+	if next != 0 {
+		if ifd1, _, err := p.parseIFD(next, IFD1); err == nil {
+			t.ifd1 = ifd1
+		}
+	}
+
+	return t, nil
+}
+
+type tiffParser struct {
+	b     []byte
+	order binary.ByteOrder
+	seen  map[uint32]bool
+}
+
+func (p *tiffParser) parseIFD(off uint32, kind IFD) (*tiffIFD, uint32, error) {
+	if p.seen[off] || uint64(off)+2 > uint64(len(p.b)) {
+		return nil, 0, errBadTIFF
+	}
+	p.seen[off] = true
+
+	n := int(p.order.Uint16(p.b[off:]))
+	start := int(off) + 2
+	if start+12*n+4 > len(p.b) {
+		return nil, 0, errBadTIFF
+	}
+
+	ifd := &tiffIFD{kind: kind}
+	for i := 0; i < n; i++ {
+		raw := p.b[start+12*i : start+12*i+12]
+		e := &tiffEntry{
+			pos:   start + 12*i,
+			tag:   p.order.Uint16(raw[0:]),
+			typ:   p.order.Uint16(raw[2:]),
+			count: p.order.Uint32(raw[4:]),
+		}
+
+		// Readers must skip unknown types, so there is nothing to preserve
+		size := uint64(typeSize(e.typ)) * uint64(e.count)
+		if size == 0 {
+			continue
+		}
+
+		if size <= 4 {
+			e.value = append([]byte{}, raw[8:8+size]...)
+		} else {
+			e.offset = p.order.Uint32(raw[8:])
+			if uint64(e.offset)+size > uint64(len(p.b)) {
+				continue
+			}
+			e.value = append([]byte{}, p.b[e.offset:uint64(e.offset)+size]...)
+		}
+
+		if subKind, ok := subIFDKind(kind, e.tag); ok && e.count == 1 && size == 4 {
+			sub, _, err := p.parseIFD(p.order.Uint32(e.value), subKind)
+			if err != nil {
+				continue
+			}
+			e.sub = sub
+		}
+
+		ifd.entries = append(ifd.entries, e)
+	}
+
+	p.resolveDataPointers(ifd)
+
+	return ifd, p.order.Uint32(p.b[start+12*n:]), nil
+}
+
+func subIFDKind(parent IFD, tag uint16) (IFD, bool) {
+	switch {
+	case parent == IFD0 && tag == tagExifIFD:
+		return ExifIFD, true
+	case parent == IFD0 && tag == tagGPSIFD:
+		return GPSIFD, true
+	case parent == ExifIFD && tag == tagInteropIFD:
+		return InteropIFD, true
+	default:
+		return 0, false
+	}
+}
+
+// Copies the blocks referenced by offset/length tag pairs out of the file.
+// Pairs that don't line up are removed, as their offsets can't be rewritten.
+func (p *tiffParser) resolveDataPointers(ifd *tiffIFD) {
+	for offTag, lenTag := range dataPointers {
+		offEntry, lenEntry := ifd.find(offTag), ifd.find(lenTag)
+		if offEntry == nil && lenEntry == nil {
+			continue
+		}
+
+		var offsets, lengths []uint32
+		if offEntry != nil && lenEntry != nil {
+			offsets = offEntry.uints(p.order)
+			lengths = lenEntry.uints(p.order)
+		}
+
+		ok := len(offsets) > 0 && len(offsets) == len(lengths)
+		for i := 0; ok && i < len(offsets); i++ {
+			end := uint64(offsets[i]) + uint64(lengths[i])
+			if end > uint64(len(p.b)) {
+				ok = false
+				break
+			}
+			offEntry.blobs = append(offEntry.blobs, append([]byte{}, p.b[offsets[i]:end]...))
+		}
+
+		if !ok {
+			ifd.remove(offTag)
+			ifd.remove(lenTag)
+		}
+	}
+}
+
+func (ifd *tiffIFD) find(tag uint16) *tiffEntry {
+	if ifd == nil {
+		return nil
+	}
+	for _, e := range ifd.entries {
+		if e.tag == tag {
+			return e
+		}
+	}
+	return nil
+}
+
+func (ifd *tiffIFD) remove(tag uint16) bool {
+	for i, e := range ifd.entries {
+		if e.tag == tag {
+			ifd.entries = append(ifd.entries[:i], ifd.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IFD of the given kind, or nil when the file doesn't have it
+func (t *tiffFile) ifd(kind IFD) *tiffIFD {
+	switch kind {
+	case IFD0:
+		return t.ifd0
+	case IFD1:
+		return t.ifd1
+	case ExifIFD:
+		return t.ifd0.subIFD(tagExifIFD)
+	case GPSIFD:
+		return t.ifd0.subIFD(tagGPSIFD)
+	case InteropIFD:
+		return t.ifd(ExifIFD).subIFD(tagInteropIFD)
+	default:
+		return nil
+	}
+}
+
+func (ifd *tiffIFD) subIFD(tag uint16) *tiffIFD {
+	if e := ifd.find(tag); e != nil {
+		return e.sub
+	}
+	return nil
+}
+
+// Decodes BYTE, SHORT and LONG values as unsigned integers
+func (e *tiffEntry) uints(order binary.ByteOrder) []uint32 {
+	var vals []uint32
+	for i := uint32(0); i < e.count; i++ {
+		switch e.typ {
+		case typeByte:
+			vals = append(vals, uint32(e.value[i]))
+		case typeShort:
+			vals = append(vals, uint32(order.Uint16(e.value[2*i:])))
+		case typeLong, typeIFD:
+			vals = append(vals, order.Uint32(e.value[4*i:]))
+		default:
+			return nil
+		}
+	}
+	return vals
+}
+
+func (t *tiffFile) encode() []byte {
+	w := &tiffWriter{order: t.order}
+
+	if t.order == binary.LittleEndian {
+		w.buf.WriteString("II")
+	} else {
+		w.buf.WriteString("MM")
+	}
+	w.putUint16(42)
+	w.putUint32(8)
+
+	next := w.writeIFD(t.ifd0)
+	if t.ifd1 != nil && len(t.ifd1.entries) > 0 {
+		w.align()
+		w.patchUint32(next, uint32(w.buf.Len()))
+		w.writeIFD(t.ifd1)
+	}
+
+	return w.buf.Bytes()
+}
+
+type tiffWriter struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+// Writes a directory followed by its out-of-line values, data blocks and
+// sub-directories. Returns the position of the next IFD link for patching.
+func (w *tiffWriter) writeIFD(ifd *tiffIFD) int {
+	w.align()
+
+	entries := append([]*tiffEntry{}, ifd.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	start := w.buf.Len()
+	w.putUint16(uint16(len(entries)))
+	w.buf.Write(make([]byte, 12*len(entries)+4))
+	next := start + 2 + 12*len(entries)
+
+	for i, e := range entries {
+		pos := start + 2 + 12*i
+		var hdr [8]byte
+		w.order.PutUint16(hdr[0:], e.tag)
+		w.order.PutUint16(hdr[2:], e.typ)
+		w.order.PutUint32(hdr[4:], e.count)
+		copy(w.buf.Bytes()[pos:], hdr[:])
+
+		value := e.value
+		if len(e.blobs) > 0 {
+			value = w.writeBlobs(e)
+		}
+
+		if len(value) <= 4 {
+			copy(w.buf.Bytes()[pos+8:], value)
+			continue
+		}
+
+		w.align()
+		// Maker notes often hold offsets relative to the TIFF header, so they
+		// stay where they were whenever the new layout leaves room for it.
+		if e.tag == tagMakerNote && int(e.offset) > w.buf.Len() {
+			w.buf.Write(make([]byte, int(e.offset)-w.buf.Len()))
+		}
+		w.patchUint32(pos+8, uint32(w.buf.Len()))
+		w.buf.Write(value)
+	}
+
+	for i, e := range entries {
+		if e.sub == nil {
+			continue
+		}
+		w.align()
+		w.patchUint32(start+2+12*i+8, uint32(w.buf.Len()))
+		w.writeIFD(e.sub)
+	}
+
+	return next
+}
+
+// Writes the blocks referenced by a data pointer entry and returns the entry
+// value holding their new offsets.
+func (w *tiffWriter) writeBlobs(e *tiffEntry) []byte {
+	value := make([]byte, len(e.value))
+	for i, blob := range e.blobs {
+		w.align()
+		off := uint32(w.buf.Len())
+		w.buf.Write(blob)
+
+		if e.typ == typeShort {
+			w.order.PutUint16(value[2*i:], uint16(off))
+		} else {
+			w.order.PutUint32(value[4*i:], off)
+		}
+	}
+	return value
+}
+
+func (w *tiffWriter) align() {
+	if w.buf.Len()%2 == 1 {
+		w.buf.WriteByte(0)
+	}
+}
+
+func (w *tiffWriter) putUint16(v uint16) {
+	var b [2]byte
+	w.order.PutUint16(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *tiffWriter) putUint32(v uint32) {
+	var b [4]byte
+	w.order.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *tiffWriter) patchUint32(pos int, v uint32) {
+	w.order.PutUint32(w.buf.Bytes()[pos:], v)
+}
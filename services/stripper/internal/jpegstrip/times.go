@@ -0,0 +1,321 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Truncation blurs timestamps down to a coarser unit
+type Truncation int
+
+const (
+	TruncateNone Truncation = iota
+	TruncateDay
+	TruncateMonth
+)
+
+// TimeEdit moves every timestamp by Shift and then truncates it. The same
+// edit is applied to EXIF, GPS, XMP and IPTC dates so they keep agreeing
+// with each other. Maker notes are opaque and are left alone.
+type TimeEdit struct {
+	Shift    time.Duration
+	Truncate Truncation
+}
+
+func (e TimeEdit) isZero() bool {
+	return e.Shift == 0 && e.Truncate == TruncateNone
+}
+
+func (e TimeEdit) apply(t time.Time) time.Time {
+	t = t.Add(e.Shift)
+	switch e.Truncate {
+	case TruncateDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case TruncateMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return t
+	}
+}
+
+// Parses the value of a time:shift type, a Go duration such as "-90m" or
+// a whole number of days such as "+3d"
+func parseShift(v string) (time.Duration, bool) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < -36500 || n > 36500 {
+			return 0, false
+		}
+		return time.Duration(n) * 24 * time.Hour, true
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d%time.Second != 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+var (
+	exifDateTags   = []ExifTag{ExifDateTime, ExifDateTimeOriginal, ExifDateTimeDigitized}
+	exifSubSecTags = []ExifTag{ExifSubSecTime, ExifSubSecTimeOriginal, ExifSubSecTimeDigitized}
+)
+
+const (
+	tagGPSTimeStamp = 0x0007
+	tagGPSDateStamp = 0x001D
+)
+
+// Rewrites the EXIF and GPS dates of an APP1 EXIF payload in place. Dates
+// have a fixed width, so nothing moves. A payload that cannot be parsed is
+// dropped.
+func editExifTimes(payload []byte, edit TimeEdit) ([]byte, bool) {
+	out := append([]byte{}, payload...)
+	tiff := out[len(exifPrefix):]
+
+	t, err := parseTIFF(tiff)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, tag := range exifDateTags {
+		e := t.ifd(tag.IFD).find(tag.Tag)
+		if e == nil || e.typ != typeASCII || len(e.value) < len(exifTimeLayout) {
+			continue
+		}
+		when, err := time.Parse(exifTimeLayout, string(e.value[:len(exifTimeLayout)]))
+		if err != nil {
+			continue
+		}
+		copy(tiff[valuePos(e):], edit.apply(when).Format(exifTimeLayout))
+	}
+
+	if edit.Truncate != TruncateNone {
+		for _, tag := range exifSubSecTags {
+			if e := t.ifd(tag.IFD).find(tag.Tag); e != nil && e.typ == typeASCII {
+				zeroDigits(tiff[valuePos(e):][:len(e.value)])
+			}
+		}
+	}
+
+	editGPSTime(tiff, t, edit)
+	return out, true
+}
+
+// Shifts the GPS date and time by the same edit. They are in UTC, so a
+// truncated GPS date can be a day off the local one.
+func editGPSTime(tiff []byte, t *tiffFile, edit TimeEdit) {
+	gps := t.ifd(GPSIFD)
+	dateEntry, timeEntry := gps.find(tagGPSDateStamp), gps.find(tagGPSTimeStamp)
+	if timeEntry == nil || timeEntry.typ != typeRational || timeEntry.count != 3 {
+		timeEntry = nil
+	}
+
+	var date time.Time
+	hasDate := dateEntry != nil && dateEntry.typ == typeASCII && len(dateEntry.value) >= 10
+	if hasDate {
+		var err error
+		date, err = time.Parse("2006:01:02", string(dateEntry.value[:10]))
+		hasDate = err == nil
+	}
+	if !hasDate && timeEntry == nil {
+		return
+	}
+
+	var nums, dens [3]uint32
+	if timeEntry != nil {
+		for i := range 3 {
+			nums[i] = t.order.Uint32(timeEntry.value[8*i:])
+			dens[i] = max(t.order.Uint32(timeEntry.value[8*i+4:]), 1)
+		}
+		date = date.Add(time.Duration(nums[0]/dens[0])*time.Hour +
+			time.Duration(nums[1]/dens[1])*time.Minute +
+			time.Duration(nums[2]/dens[2])*time.Second)
+	}
+
+	when := edit.apply(date)
+	if hasDate {
+		copy(tiff[valuePos(dateEntry):], when.Format("2006:01:02"))
+	}
+	if timeEntry != nil {
+		frac := nums[2] % dens[2]
+		if edit.Truncate != TruncateNone {
+			frac = 0
+		}
+		vals := [3][2]uint32{
+			{uint32(when.Hour()), 1},
+			{uint32(when.Minute()), 1},
+			{uint32(when.Second())*dens[2] + frac, dens[2]},
+		}
+		b := tiff[valuePos(timeEntry):]
+		for i, v := range vals {
+			t.order.PutUint32(b[8*i:], v[0])
+			t.order.PutUint32(b[8*i+4:], v[1])
+		}
+	}
+}
+
+// Returns where the value of an entry is stored in the TIFF data
+func valuePos(e *tiffEntry) int {
+	if len(e.value) <= 4 {
+		return e.pos + 8
+	}
+	return int(e.offset)
+}
+
+func zeroDigits(b []byte) {
+	for i, c := range b {
+		if c >= '0' && c <= '9' {
+			b[i] = '0'
+		}
+	}
+}
+
+// XMP dates are ISO 8601 with as much precision as the writer had
+var xmpDateLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// XMP properties holding dates that move with the EXIF ones
+var xmpDateProps = map[XMPProperty]bool{
+	{nsXMP, "CreateDate"}:         true,
+	{nsXMP, "ModifyDate"}:         true,
+	{nsXMP, "MetadataDate"}:       true,
+	{nsPhotoshop, "DateCreated"}:  true,
+	{nsEXIF, "DateTimeOriginal"}:  true,
+	{nsEXIF, "DateTimeDigitized"}: true,
+	{nsEXIF, "GPSTimeStamp"}:      true,
+	{nsTIFF, "DateTime"}:          true,
+	{nsResourceEvent, "when"}:     true, // xmpMM:History entries
+}
+
+// Returns a rewriter for XMP date values that applies the edit and keeps the
+// precision of the original value
+func xmpDateRewriter(edit TimeEdit) func(space, local, v string) (string, bool) {
+	return func(space, local, v string) (string, bool) {
+		if !xmpDateProps[XMPProperty{space, local}] {
+			return v, false
+		}
+
+		v = strings.TrimSpace(v)
+		for _, layout := range xmpDateLayouts {
+			when, err := time.Parse(layout, v)
+			if err != nil {
+				continue
+			}
+			if i := strings.IndexByte(v, '.'); i >= 0 && edit.Truncate == TruncateNone {
+				// Keep the fraction the writer had
+				layout = strings.Replace(layout, "05", "05."+strings.Repeat("0", fractionDigits(v[i+1:])), 1)
+			}
+			return edit.apply(when).Format(layout), true
+		}
+		return v, false
+	}
+}
+
+func fractionDigits(s string) int {
+	n := 0
+	for n < len(s) && n < 9 && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return max(n, 1)
+}
+
+// IPTC IIM datasets holding dates and times, as record 2 dataset numbers.
+// Dates are CCYYMMDD and times HHMMSS±HHMM.
+var iptcDateTimes = [][2]byte{
+	{55, 60}, // DateCreated, TimeCreated
+	{62, 63}, // DigitalCreationDate, DigitalCreationTime
+}
+
+// Rewrites the IPTC dates of an APP13 payload in place. It reports whether
+// anything changed, as the IPTC digest no longer matches then.
+func editIPTCTimes(payload []byte, edit TimeEdit) ([]byte, bool) {
+	out := append([]byte{}, payload...)
+	resources, err := parseImageResources(out[len(photoshopPrefix):])
+	if err != nil {
+		return payload, false
+	}
+
+	for _, res := range resources {
+		if res.id != ResourceIPTC {
+			continue
+		}
+		datasets := iimDatasets(res.data)
+		for _, pair := range iptcDateTimes {
+			editIIMDateTime(datasets[pair[0]], datasets[pair[1]], edit)
+		}
+	}
+	return out, !bytes.Equal(out, payload)
+}
+
+// Returns the values of the record 2 datasets, pointing into b
+func iimDatasets(b []byte) map[byte][]byte {
+	datasets := make(map[byte][]byte)
+	for len(b) >= 5 && b[0] == 0x1C {
+		record, number := b[1], b[2]
+		size := int(binary.BigEndian.Uint16(b[3:]))
+		b = b[5:]
+
+		// Extended datasets give the length of their length field
+		if size&0x8000 != 0 {
+			n := size & 0x7FFF
+			if n > 4 || n > len(b) {
+				return datasets
+			}
+			size = 0
+			for _, c := range b[:n] {
+				size = size<<8 | int(c)
+			}
+			b = b[n:]
+		}
+		if size > len(b) {
+			return datasets
+		}
+
+		if record == 2 {
+			if _, seen := datasets[number]; !seen {
+				datasets[number] = b[:size]
+			}
+		}
+		b = b[size:]
+	}
+	return datasets
+}
+
+func editIIMDateTime(date, clock []byte, edit TimeEdit) {
+	if len(date) != 8 {
+		return
+	}
+	when, err := time.Parse("20060102", string(date))
+	if err != nil {
+		return
+	}
+
+	hasClock := len(clock) >= 6
+	if hasClock {
+		hms, err := time.Parse("150405", string(clock[:6]))
+		if err != nil {
+			hasClock = false
+		} else {
+			when = when.Add(time.Duration(hms.Hour())*time.Hour + time.Duration(hms.Minute())*time.Minute + time.Duration(hms.Second())*time.Second)
+		}
+	}
+
+	when = edit.apply(when)
+	copy(date, when.Format("20060102"))
+	if hasClock {
+		copy(clock, when.Format("150405"))
+	}
+}
@@ -0,0 +1,157 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func makeDatedImage() []byte {
+	exif := testutil.Exif{
+		IFD0: []testutil.Tag{testutil.ASCII(0x0132, "2024:05:01 23:30:00")},
+		Exif: []testutil.Tag{
+			testutil.ASCII(0x9003, "2024:05:01 23:30:00"),
+			testutil.ASCII(0x9004, "2024:05:01 23:30:00"),
+			testutil.ASCII(0x9011, "+02:00"),
+			testutil.ASCII(0x9291, "123"),
+		},
+		GPS: []testutil.Tag{
+			testutil.Rational(0x0007, 21, 1, 30, 1, 125, 10),
+			testutil.ASCII(0x001D, "2024:05:01"),
+		},
+	}.Payload()
+
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreateDate="2024-05-01T23:30:00.25+02:00">` +
+		`<xmp:ModifyDate>2024-05-01T23:30</xmp:ModifyDate><xmp:Label>2024-05-01</xmp:Label>` +
+		`</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+	iptc := []byte{
+		0x1C, 0x02, 55, 0x00, 0x08, '2', '0', '2', '4', '0', '5', '0', '1',
+		0x1C, 0x02, 60, 0x00, 0x0B, '2', '3', '3', '0', '0', '0', '+', '0', '2', '0', '0',
+	}
+
+	return testutil.MakeJPEG(
+		testutil.MakeSegment(0xE1, exif),
+		testutil.MakeSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+xmp)),
+		makePhotoshopSegment(makeResource(ResourceIPTC, iptc), makeResource(ResourceIPTCDigest, make([]byte, 16))),
+		testutil.MakeSOS([]byte{0x11}),
+	)
+}
+
+func TestEditTimes(t *testing.T) {
+	src := makeDatedImage()
+
+	t.Run("Shift moves every date together", func(t *testing.T) {
+		got := stripBytes(t, src, policyFor("time:shift=1h"))
+
+		tf := mustParseExif(t, got[bytes.Index(got, exifPrefix):])
+		for _, tag := range exifDateTags {
+			if v := tf.ifd(tag.IFD).find(tag.Tag).str(); v != "2024:05:02 00:30:00" {
+				t.Fatalf("tag 0x%04X is %q", tag.Tag, v)
+			}
+		}
+		if v := tf.ifd(ExifIFD).find(0x9291).str(); v != "123" {
+			t.Fatalf("sub-second digits changed to %q", v)
+		}
+		if v := tf.ifd(ExifIFD).find(0x9011).str(); v != "+02:00" {
+			t.Fatalf("offset changed to %q", v)
+		}
+
+		gps := tf.ifd(GPSIFD)
+		if v := gps.find(tagGPSDateStamp).str(); v != "2024:05:01" {
+			t.Fatalf("GPS date is %q", v)
+		}
+		if hms := gps.find(tagGPSTimeStamp).rationals(tf.order); hms[0] != 22 || hms[1] != 30 || hms[2] != 12.5 {
+			t.Fatalf("GPS time is %v", hms)
+		}
+
+		for _, want := range []string{
+			`xmp:CreateDate="2024-05-02T00:30:00.25+02:00"`,
+			`<xmp:ModifyDate>2024-05-02T00:30</xmp:ModifyDate>`,
+			`<xmp:Label>2024-05-01</xmp:Label>`,
+			"20240502\x1C\x02\x3C\x00\x0B003000+0200",
+		} {
+			if !bytes.Contains(got, []byte(want)) {
+				t.Fatalf("expected %q in output", want)
+			}
+		}
+		if bytes.Contains(got, makeResource(ResourceIPTCDigest, make([]byte, 16))) {
+			t.Fatalf("expected the stale IPTC digest to be dropped")
+		}
+	})
+
+	t.Run("Stale digest goes without other resources selected", func(t *testing.T) {
+		p := &Policy{}
+		p.EditTimes(TimeEdit{Shift: time.Hour})
+		got := stripBytes(t, src, p)
+
+		if bytes.Contains(got, makeResource(ResourceIPTCDigest, make([]byte, 16))) {
+			t.Fatalf("expected the stale IPTC digest to be dropped")
+		}
+	})
+
+	t.Run("Truncate keeps the precision of each value", func(t *testing.T) {
+		got := stripBytes(t, src, policyFor("time:truncate=month"))
+
+		for _, want := range []string{
+			"2024:05:01 00:00:00",
+			`xmp:CreateDate="2024-05-01T00:00:00+02:00"`,
+			`<xmp:ModifyDate>2024-05-01T00:00</xmp:ModifyDate>`,
+			"20240501\x1C\x02\x3C\x00\x0B000000+0200",
+		} {
+			if !bytes.Contains(got, []byte(want)) {
+				t.Fatalf("expected %q in output", want)
+			}
+		}
+		tf := mustParseExif(t, got[bytes.Index(got, exifPrefix):])
+		if v := tf.ifd(ExifIFD).find(0x9291).str(); v != "000" {
+			t.Fatalf("sub-second digits are %q", v)
+		}
+		if hms := tf.ifd(GPSIFD).find(tagGPSTimeStamp).rationals(tf.order); hms[0] != 0 || hms[2] != 0 {
+			t.Fatalf("GPS time is %v", hms)
+		}
+	})
+
+	t.Run("Shift then truncate", func(t *testing.T) {
+		got := stripBytes(t, src, policyFor("time:shift=-31d", "time:truncate=day"))
+
+		if !bytes.Contains(got, []byte("2024:03:31 00:00:00")) {
+			t.Fatalf("expected the date to move back a month")
+		}
+	})
+
+	t.Run("Nothing is resized", func(t *testing.T) {
+		got := stripBytes(t, src, policyFor("time:shift=36h"))
+		if want := len(src) - len(makeResource(ResourceIPTCDigest, make([]byte, 16))); len(got) != want {
+			t.Fatalf("output is %d bytes, want %d", len(got), want)
+		}
+	})
+
+	t.Run("Shift values", func(t *testing.T) {
+		for v, want := range map[string]time.Duration{
+			"90m": 90 * time.Minute,
+			"-3d": -72 * time.Hour,
+			"+2d": 48 * time.Hour,
+		} {
+			if d, ok := parseShift(v); !ok || d != want {
+				t.Fatalf("parseShift(%q) = %v, %v", v, d, ok)
+			}
+		}
+		for _, v := range []string{"time:shift=", "time:shift=1.5s", "time:shift=abc", "time:shift=1xd", "time:truncate=year"} {
+			if NewPolicy().AddType(v) {
+				t.Fatalf("expected %q to be rejected", v)
+			}
+		}
+	})
+
+	t.Run("Unrelated XMP is untouched", func(t *testing.T) {
+		packet := `<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreatorTool="x"/>`
+		got, err := rewriteXMP([]byte(packet), xmpEdit{value: xmpDateRewriter(TimeEdit{Shift: time.Hour})})
+		if err != nil || string(got) != packet {
+			t.Fatalf("unexpected rewrite %q, %v", got, err)
+		}
+	})
+}
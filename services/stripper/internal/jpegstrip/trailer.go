@@ -0,0 +1,67 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"io"
+)
+
+// TrailerMode decides what happens to bytes found after the EOI marker
+type TrailerMode int
+
+const (
+	// TrailerKeep copies the trailing bytes unchanged
+	TrailerKeep TrailerMode = iota
+	// TrailerDrop ends the output at EOI
+	TrailerDrop
+)
+
+// TrailerKind guesses what was appended to the image
+type TrailerKind string
+
+const (
+	TrailerJPEG    TrailerKind = "jpeg"    // another image, such as an MPF secondary image
+	TrailerMP4     TrailerKind = "mp4"     // a motion photo video
+	TrailerZIP     TrailerKind = "zip"     // an archive, the classic polyglot
+	TrailerSamsung TrailerKind = "samsung" // Samsung SEFH/SEFT trailer
+	TrailerPadding TrailerKind = "padding" // zero bytes only
+	TrailerUnknown TrailerKind = "unknown"
+)
+
+// Trailer describes the bytes after the EOI marker
+type Trailer struct {
+	Offset int64       `json:"offset"`
+	Length int64       `json:"length"`
+	Type   TrailerKind `json:"type"`
+}
+
+func classifyTrailer(data []byte) TrailerKind {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return TrailerJPEG
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		return TrailerMP4
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return TrailerZIP
+	case bytes.HasSuffix(data, []byte("SEFT")):
+		return TrailerSamsung
+	case len(bytes.Trim(data, "\x00")) == 0:
+		return TrailerPadding
+	default:
+		return TrailerUnknown
+	}
+}
+
+// Reads what is left after EOI and describes it, or returns nil when the
+// image ends at EOI
+func readTrailer(sr *segmentReader) (*Trailer, error) {
+	offset := sr.off
+	data, err := io.ReadAll(sr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	return &Trailer{Offset: offset, Length: int64(len(data)), Type: classifyTrailer(data)}, nil
+}
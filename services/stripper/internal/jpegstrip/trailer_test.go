@@ -0,0 +1,77 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+func TestClassifyTrailer(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want TrailerKind
+	}{
+		{testutil.MakeJPEG(testutil.MakeSOS([]byte{0x11})), TrailerJPEG},
+		{[]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00"), TrailerMP4},
+		{[]byte("PK\x03\x04\x14\x00"), TrailerZIP},
+		{[]byte("SEFH....\x00\x00\x00\x10SEFT"), TrailerSamsung},
+		{make([]byte, 16), TrailerPadding},
+		{[]byte("hello"), TrailerUnknown},
+	}
+
+	for _, c := range cases {
+		if got := classifyTrailer(c.data); got != c.want {
+			t.Fatalf("classifyTrailer(%q) = %s, want %s", c.data, got, c.want)
+		}
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	img := testutil.MakeJPEG(testutil.MakeSegment(0xFE, []byte("hi")), testutil.MakeSOS([]byte{0x11, 0x22}))
+	video := []byte("\x00\x00\x00\x18ftypmp42video")
+	withVideo := append(append([]byte{}, img...), video...)
+
+	t.Run("Kept by default", func(t *testing.T) {
+		if got := stripBytes(t, withVideo, NewPolicy()); !bytes.Equal(got, withVideo) {
+			t.Fatalf("expected trailer to be kept")
+		}
+	})
+
+	t.Run("Dropped with the trailer type", func(t *testing.T) {
+		if got := stripBytes(t, withVideo, policyFor("trailer")); !bytes.Equal(got, img) {
+			t.Fatalf("expected output to end at EOI")
+		}
+	})
+
+	t.Run("Reported by Inspect", func(t *testing.T) {
+		report, err := Inspect(bytes.NewReader(withVideo))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		want := Trailer{Offset: int64(len(img)), Length: int64(len(video)), Type: TrailerMP4}
+		if report.Trailer == nil || *report.Trailer != want {
+			t.Fatalf("got trailer %+v, want %+v", report.Trailer, want)
+		}
+	})
+
+	t.Run("Not reported when the image ends at EOI", func(t *testing.T) {
+		report, err := Inspect(bytes.NewReader(img))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		if report.Trailer != nil {
+			t.Fatalf("unexpected trailer %+v", report.Trailer)
+		}
+	})
+
+	t.Run("Kept when baking the orientation", func(t *testing.T) {
+		src := append(withOrientation(makeCodedJPEG(t, 32, 16, false), 6), video...)
+
+		p := NewPolicy()
+		p.Orientation = OrientationBake
+		if got := stripBytes(t, src, p); !bytes.HasSuffix(got, append([]byte{0xFF, 0xD9}, video...)) {
+			t.Fatalf("expected trailer after the rotated image")
+		}
+	})
+}
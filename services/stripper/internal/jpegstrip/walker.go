@@ -0,0 +1,266 @@
+package jpegstrip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// segment is one marker segment as read from the input
+type segment struct {
+	marker  byte
+	offset  int64  // position of the 0xFF that starts the marker
+	payload []byte // nil for markers without a length field
+}
+
+// segmentReader walks the marker segments of a JPEG stream and keeps track
+// of the input offset. Strip and Inspect share it so they agree on where
+// every segment starts and ends.
+type segmentReader struct {
+	r   *bufio.Reader
+	off int64
+
+	mode    ParseMode
+	repairs []Repair
+	frame   bool // a frame header was seen, for strict mode
+
+	budget *budget // nil for walks over our own output
+}
+
+func newSegmentReader(in io.Reader) *segmentReader {
+	return &segmentReader{r: bufio.NewReader(in)}
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.off += int64(n)
+	return n, err
+}
+
+func (sr *segmentReader) readByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.off++
+	}
+	return b, err
+}
+
+func (sr *segmentReader) readSOI() error {
+	var hdr [2]byte
+	_, err := io.ReadFull(sr, hdr[:])
+	if err != nil {
+		return sr.readFailed(0xD8, 0, ReasonEOFInSegment, err)
+	}
+
+	if hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return &Error{Offset: 0, Reason: ReasonNotJPEG}
+	}
+	return nil
+}
+
+// Reads the next marker, skipping anything up to the next 0xFF and any
+// fill bytes, followed by its payload when the marker has a length field.
+// What is skipped is recorded as a repair, and stray bytes are rejected in
+// strict mode.
+func (sr *segmentReader) next() (segment, error) {
+	var seg segment
+
+	start := sr.off
+	b, err := sr.readByte()
+	for err == nil && b != 0xFF {
+		b, err = sr.readByte()
+	}
+	if skipped := sr.off - start - 1; err == nil && skipped > 0 {
+		if sr.mode == ParseStrict {
+			return seg, &Error{Offset: start, Reason: ReasonStrayBytes}
+		}
+		sr.repair(start, RepairSkippedBytes, skipped)
+	}
+
+	fill := sr.off - 1
+	for err == nil && b == 0xFF {
+		seg.offset = sr.off - 1
+		b, err = sr.readByte()
+	}
+	if err != nil {
+		if eoi, ok := sr.recoverEOF(err); ok {
+			return eoi, nil
+		}
+		return seg, sr.readFailed(0, sr.off, ReasonMissingEOI, err)
+	}
+	// Fill is allowed before any marker (B.1.1.2), so even strict mode only
+	// reports it
+	if n := seg.offset - fill; n > 0 {
+		sr.repair(fill, RepairRemovedFill, n)
+	}
+
+	seg.marker = b
+	if sr.mode == ParseStrict {
+		if err := sr.checkOrder(seg); err != nil {
+			return seg, err
+		}
+	}
+	if isNoLengthMarker(seg.marker) {
+		return seg, nil
+	}
+
+	seg.payload, err = sr.readPayload(seg)
+	if err == nil && sr.budget != nil {
+		err = sr.budget.count(seg)
+	}
+	if err != nil && sr.mode == ParseLenient && errors.Is(err, ErrTruncated) {
+		// The partial segment goes and the image ends in front of it
+		sr.repair(seg.offset, RepairDroppedSegment, sr.off-seg.offset)
+		sr.repair(seg.offset, RepairAddedEOI, 0)
+		return segment{marker: 0xD9, offset: seg.offset}, nil
+	}
+	return seg, err
+}
+
+// Rejects markers that don't belong where they are, in strict mode. SOI and
+// EOI are handled by the callers.
+func (sr *segmentReader) checkOrder(seg segment) error {
+	switch {
+	case seg.marker == 0xD8, seg.marker >= 0xD0 && seg.marker <= 0xD7:
+		// A second SOI, or a restart marker outside of a scan
+	case seg.marker < 0xC0:
+		// TEM and reserved markers
+	case seg.marker == 0xDA && !sr.frame:
+		// A scan before the frame header
+	default:
+		if isFrameMarker(seg.marker) {
+			sr.frame = true
+		}
+		return nil
+	}
+	return &Error{Offset: seg.offset, Marker: seg.marker, Reason: ReasonNonCanonical}
+}
+
+// Returns the error for a failed read, with reason standing for running
+// out of input
+func (sr *segmentReader) readFailed(marker byte, offset int64, reason Reason, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &Error{Offset: offset, Marker: marker, Reason: reason}
+	}
+	return &Error{Offset: offset, Marker: marker, Reason: ReasonRead, Err: err}
+}
+
+// Copies the entropy-coded data that follows an SOS header, including
+// stuffed 0xFF00 bytes and RST markers, and stops in front of the next
+// marker so next can pick it up
+func (sr *segmentReader) copyEntropy(out io.Writer) error {
+	for {
+		_, err := sr.r.Peek(2)
+		if err != nil && sr.mode == ParseLenient && isEOF(err) {
+			return sr.endScan(out)
+		}
+		if err != nil {
+			return sr.readFailed(0xDA, sr.off, ReasonEOFInScan, err)
+		}
+
+		buf, _ := sr.r.Peek(sr.r.Buffered())
+		n := bytes.IndexByte(buf, 0xFF)
+		switch {
+		case n < 0:
+			n = len(buf)
+		case n > 0:
+		case buf[1] == 0x00 || (buf[1] >= 0xD0 && buf[1] <= 0xD7):
+			n = 2
+		default:
+			return nil
+		}
+
+		_, err = out.Write(buf[:n])
+		if err != nil {
+			return &Error{Offset: sr.off, Marker: 0xDA, Reason: ReasonWrite, Err: err}
+		}
+		sr.r.Discard(n)
+		sr.off += int64(n)
+	}
+}
+
+// Writes the last byte of a scan that the input cut short, unless it is the
+// first half of a marker, and records the repair. next then adds EOI.
+func (sr *segmentReader) endScan(out io.Writer) error {
+	sr.repair(sr.off, RepairTruncatedScan, 0)
+
+	buf, _ := sr.r.Peek(sr.r.Buffered())
+	if len(buf) == 1 && buf[0] != 0xFF {
+		if _, err := out.Write(buf); err != nil {
+			return &Error{Offset: sr.off, Marker: 0xDA, Reason: ReasonWrite, Err: err}
+		}
+	}
+	sr.r.Discard(len(buf))
+	sr.off += int64(len(buf))
+	return nil
+}
+
+// Returns the size of the segment in the input, marker and length included
+func (s segment) size() int {
+	if isNoLengthMarker(s.marker) {
+		return 2
+	}
+	return 4 + len(s.payload)
+}
+
+// Writes a segment back out unchanged
+func (s segment) writeTo(out io.Writer) error {
+	if isNoLengthMarker(s.marker) {
+		_, err := out.Write([]byte{0xFF, s.marker})
+		return err
+	}
+	return writeSegment(out, s.marker, s.payload)
+}
+
+// Reads the length field and payload of a segment whose marker was read
+func (sr *segmentReader) readPayload(seg segment) ([]byte, error) {
+	var lengthBuf [2]byte
+	_, err := io.ReadFull(sr, lengthBuf[:])
+	if err != nil {
+		return nil, sr.readFailed(seg.marker, seg.offset, ReasonEOFInSegment, err)
+	}
+
+	length := binary.BigEndian.Uint16(lengthBuf[:])
+	if length < 2 {
+		return nil, &Error{Offset: seg.offset, Marker: seg.marker, Reason: ReasonBadLength}
+	}
+
+	payload := make([]byte, length-2)
+	_, err = io.ReadFull(sr, payload)
+	if err != nil {
+		return nil, sr.readFailed(seg.marker, seg.offset, ReasonEOFInSegment, err)
+	}
+
+	return payload, nil
+}
+
+func writeSegment(out io.Writer, marker byte, payload []byte) error {
+	if len(payload) > 0xFFFF-2 {
+		return &Error{Offset: -1, Marker: marker, Reason: ReasonTooLarge}
+	}
+
+	var hdr [4]byte
+	hdr[0], hdr[1] = 0xFF, marker
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)+2))
+
+	_, err := out.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(payload)
+	return err
+}
+
+func isNoLengthMarker(marker byte) bool {
+	// SOI D8, EOI D9, RST0-7 D0–D7, TEM 01
+	if marker == 0xD8 || marker == 0xD9 || marker == 0x01 {
+		return true
+	}
+	if marker >= 0xD0 && marker <= 0xD7 {
+		return true
+	}
+	return false
+}
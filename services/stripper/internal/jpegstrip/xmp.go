@@ -0,0 +1,326 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+)
+
+var xmpExtensionPrefix = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+const (
+	nsXMP           = "http://ns.adobe.com/xap/1.0/"
+	nsXMPMM         = "http://ns.adobe.com/xap/1.0/mm/"
+	nsXMPNote       = "http://ns.adobe.com/xmp/note/"
+	nsResourceEvent = "http://ns.adobe.com/xap/1.0/sType/ResourceEvent#"
+	nsPhotoshop     = "http://ns.adobe.com/photoshop/1.0/"
+	nsCameraRaw     = "http://ns.adobe.com/camera-raw-settings/1.0/"
+	nsEXIF          = "http://ns.adobe.com/exif/1.0/"
+	nsTIFF          = "http://ns.adobe.com/tiff/1.0/"
+)
+
+// Some writers use the usual prefixes without declaring them
+var wellKnownPrefixes = map[string]string{
+	"xml":       "http://www.w3.org/XML/1998/namespace",
+	"xmp":       nsXMP,
+	"xmpMM":     nsXMPMM,
+	"stEvt":     nsResourceEvent,
+	"xmpNote":   nsXMPNote,
+	"photoshop": nsPhotoshop,
+	"crs":       nsCameraRaw,
+	"exif":      nsEXIF,
+	"tiff":      nsTIFF,
+}
+
+// XMPProperty names XMP properties by namespace URI and local name. An empty
+// Local matches the whole namespace and a Local ending in "*" matches every
+// property that starts with the rest.
+type XMPProperty struct {
+	Space string
+	Local string
+}
+
+var (
+	XMPHistory            = XMPProperty{nsXMPMM, "History"}
+	XMPDerivedFrom        = XMPProperty{nsXMPMM, "DerivedFrom"}
+	XMPDocumentAncestors  = XMPProperty{nsPhotoshop, "DocumentAncestors"}
+	XMPCameraRaw          = XMPProperty{nsCameraRaw, ""}
+	XMPGPS                = XMPProperty{nsEXIF, "GPS*"}
+	XMPHasExtendedPointer = XMPProperty{nsXMPNote, "HasExtendedXMP"}
+)
+
+// xmpGroups are the metadataType values that remove parts of the XMP packet
+var xmpGroups = map[string][]XMPProperty{
+	"xmp:history":    {XMPHistory, XMPDerivedFrom, XMPDocumentAncestors},
+	"xmp:camera-raw": {XMPCameraRaw},
+	"xmp:gps":        {XMPGPS},
+}
+
+func (p XMPProperty) matches(space, local string) bool {
+	if p.Space != space {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(p.Local, "*"); ok {
+		return strings.HasPrefix(local, prefix)
+	}
+	return p.Local == "" || p.Local == local
+}
+
+func matchesAny(remove map[XMPProperty]bool, space, local string) bool {
+	for p := range remove {
+		if p.matches(space, local) {
+			return true
+		}
+	}
+	return false
+}
+
+// extendedXMP is the header of one chunk of an extended XMP packet, which is
+// split over as many APP1 segments as it needs
+type extendedXMP struct {
+	guid   string // MD5 of the full extension, as 32 hex digits
+	length uint32 // size of the full extension
+	offset uint32 // where this chunk goes
+}
+
+func parseExtendedXMP(payload []byte) (extendedXMP, bool) {
+	if !bytes.HasPrefix(payload, xmpExtensionPrefix) || len(payload) < len(xmpExtensionPrefix)+40 {
+		return extendedXMP{}, false
+	}
+	b := payload[len(xmpExtensionPrefix):]
+	return extendedXMP{
+		guid:   string(b[:32]),
+		length: binary.BigEndian.Uint32(b[32:]),
+		offset: binary.BigEndian.Uint32(b[36:]),
+	}, true
+}
+
+// xmpEdit is what rewriteXMP changes in a packet
+type xmpEdit struct {
+	remove map[XMPProperty]bool
+
+	// value returns the new value of a simple property and whether it
+	// changed. It may be nil.
+	value func(space, local, v string) (string, bool)
+}
+
+func (e xmpEdit) rewrite(space, local, v string) (string, bool) {
+	if e.value == nil {
+		return v, false
+	}
+	return e.value(space, local, v)
+}
+
+// Rewrites an APP1 XMP payload as the edit says. The segment is dropped when
+// the packet can't be parsed, since what it holds is unknown.
+func editXMP(payload []byte, edit xmpEdit) ([]byte, bool) {
+	header := len(xmpPrefix)
+	if len(payload) > header && payload[header] == 0 {
+		header++
+	}
+
+	packet, err := rewriteXMP(payload[header:], edit)
+	if err != nil {
+		return nil, false
+	}
+
+	out := append(payload[:header:header], packet...)
+	if len(out) > 0xFFFF-2 {
+		out = trimXMPPadding(out, len(out)-(0xFFFF-2))
+	}
+	if len(out) > 0xFFFF-2 {
+		return nil, false
+	}
+	return out, true
+}
+
+var errUnbalancedXMP = errors.New("unbalanced XMP packet")
+
+// Removes properties from an RDF/XML packet and rewrites the values of
+// others. Removed elements are cut out of the original bytes and only start
+// tags and text that change are written again, so everything else keeps its
+// exact formatting.
+func rewriteXMP(data []byte, edit xmpEdit) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+
+	var out bytes.Buffer
+	scopes := []map[string]string{wellKnownPrefixes}
+	names := []xml.Name{{}} // resolved names of the open elements
+	last := 0               // data is copied to out up to here
+	skip := 0               // depth of the element being removed, 0 when none
+	depth := 0
+
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := int(d.InputOffset())
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			scope := nsScope(scopes[len(scopes)-1], t.Attr)
+			scopes = append(scopes, scope)
+			names = append(names, xml.Name{Space: scope[t.Name.Space], Local: t.Name.Local})
+			if skip > 0 {
+				continue
+			}
+
+			if matchesAny(edit.remove, scope[t.Name.Space], t.Name.Local) {
+				out.Write(bytes.TrimRight(data[last:start], " \t\r\n"))
+				last = start
+				skip = depth
+				continue
+			}
+
+			attrs := t.Attr[:0:0]
+			changed := false
+			for _, a := range t.Attr {
+				if removesAttr(edit.remove, scope, a) {
+					changed = true
+					continue
+				}
+				if a.Name.Space != "" && a.Name.Space != "xmlns" {
+					if v, ok := edit.rewrite(scope[a.Name.Space], a.Name.Local, a.Value); ok {
+						a.Value, changed = v, true
+					}
+				}
+				attrs = append(attrs, a)
+			}
+			if !changed {
+				continue
+			}
+
+			out.Write(data[last:start])
+			t.Attr = attrs
+			writeStartTag(&out, t, bytes.HasSuffix(data[start:end], []byte("/>")))
+			last = end
+
+		case xml.CharData:
+			name := names[len(names)-1]
+			if skip > 0 || depth == 0 {
+				continue
+			}
+			if v, ok := edit.rewrite(name.Space, name.Local, string(t)); ok {
+				out.Write(data[last:start])
+				xml.EscapeText(&out, []byte(v))
+				last = end
+			}
+
+		case xml.EndElement:
+			if depth == 0 {
+				return nil, errUnbalancedXMP
+			}
+			if skip == depth {
+				skip = 0
+				last = end
+			}
+			depth--
+			scopes = scopes[:len(scopes)-1]
+			names = names[:len(names)-1]
+		}
+	}
+
+	if depth != 0 {
+		return nil, errUnbalancedXMP
+	}
+	out.Write(data[last:])
+	return out.Bytes(), nil
+}
+
+// Returns the prefix to namespace mapping in effect inside an element
+func nsScope(parent map[string]string, attrs []xml.Attr) map[string]string {
+	var scope map[string]string
+	for _, a := range attrs {
+		var prefix string
+		switch {
+		case a.Name.Space == "xmlns":
+			prefix = a.Name.Local
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			prefix = "" // default namespace
+		default:
+			continue
+		}
+
+		if scope == nil {
+			scope = maps.Clone(parent)
+		}
+		scope[prefix] = a.Value
+	}
+
+	if scope == nil {
+		return parent
+	}
+	return scope
+}
+
+// Reports whether an attribute is a removed property, or declares a
+// namespace that is removed as a whole
+func removesAttr(remove map[XMPProperty]bool, scope map[string]string, a xml.Attr) bool {
+	switch a.Name.Space {
+	case "xmlns":
+		return remove[XMPProperty{Space: a.Value}]
+	case "":
+		return false // unprefixed attributes are in no namespace
+	default:
+		return matchesAny(remove, scope[a.Name.Space], a.Name.Local)
+	}
+}
+
+func writeStartTag(out *bytes.Buffer, t xml.StartElement, selfClosing bool) {
+	out.WriteByte('<')
+	writeName(out, t.Name)
+	for _, a := range t.Attr {
+		out.WriteByte(' ')
+		writeName(out, a.Name)
+		out.WriteString(`="`)
+		attrEscaper.WriteString(out, a.Value)
+		out.WriteByte('"')
+	}
+	if selfClosing {
+		out.WriteString("/>")
+	} else {
+		out.WriteByte('>')
+	}
+}
+
+func writeName(out *bytes.Buffer, name xml.Name) {
+	if name.Space != "" {
+		out.WriteString(name.Space)
+		out.WriteByte(':')
+	}
+	out.WriteString(name.Local)
+}
+
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	`"`, "&quot;",
+	"\t", "&#x9;",
+	"\n", "&#xA;",
+	"\r", "&#xD;",
+)
+
+// Removes up to n bytes of the whitespace padding XMP writers leave in front
+// of the closing xpacket instruction
+func trimXMPPadding(payload []byte, n int) []byte {
+	end := bytes.LastIndex(payload, []byte("<?xpacket end"))
+	if end < 0 {
+		return payload
+	}
+
+	pad := end
+	for pad > 0 && end-pad < n && strings.IndexByte(" \t\r\n", payload[pad-1]) >= 0 {
+		pad--
+	}
+	return append(payload[:pad:pad], payload[end:]...)
+}
@@ -0,0 +1,190 @@
+package jpegstrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/daria/exif-cleaner/services/stripper/internal/testutil"
+)
+
+// helper: build one APP1 extended XMP chunk
+func makeExtendedXMP(guid string, length, offset uint32, data string) []byte {
+	payload := append([]byte{}, xmpExtensionPrefix...)
+	payload = append(payload, guid...)
+	payload = binary.BigEndian.AppendUint32(payload, length)
+	payload = binary.BigEndian.AppendUint32(payload, offset)
+	return testutil.MakeSegment(0xE1, append(payload, data...))
+}
+
+func TestExtendedXMP(t *testing.T) {
+	guidA := strings.Repeat("A", 32)
+	guidB := strings.Repeat("B", 32)
+	mainAttr := testutil.MakeSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+
+		`<rdf:Description rdf:about="" xmpNote:HasExtendedXMP="`+guidA+`" xmp:Rating="3"/>`))
+	mainElem := testutil.MakeSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+
+		`<rdf:Description rdf:about=""><xmpNote:HasExtendedXMP>`+guidA+`</xmpNote:HasExtendedXMP><xmp:Rating>3</xmp:Rating></rdf:Description>`))
+	chunk2 := makeExtendedXMP(guidA, 10, 5, "depth")
+	chunk1 := makeExtendedXMP(guidA, 10, 0, "image")
+	other := makeExtendedXMP(guidB, 4, 0, "blob")
+	sos := testutil.MakeSOS([]byte{0x11, 0x22})
+
+	t.Run("xmp removes the main packet and its extension", func(t *testing.T) {
+		got := stripBytes(t, testutil.MakeJPEG(mainAttr, chunk2, chunk1, other, sos), policyFor("xmp"))
+
+		if testutil.ContainsMarker(got, 0xE1) {
+			t.Fatalf("expected every XMP segment to be removed")
+		}
+	})
+
+	t.Run("xmp:extended keeps the main packet without its pointer", func(t *testing.T) {
+		for _, main := range [][]byte{mainAttr, mainElem} {
+			got := stripBytes(t, testutil.MakeJPEG(main, chunk2, chunk1, other, sos), policyFor("xmp:extended"))
+
+			if bytes.Contains(got, xmpExtensionPrefix) {
+				t.Fatalf("expected extended XMP chunks to be removed")
+			}
+			if bytes.Contains(got, []byte("HasExtendedXMP")) {
+				t.Fatalf("expected HasExtendedXMP pointer to be removed:\n%s", got)
+			}
+			if !bytes.Contains(got, []byte("xmp:Rating")) {
+				t.Fatalf("expected the rest of the main packet to be kept")
+			}
+		}
+	})
+
+	t.Run("Inspect groups the chunks by GUID", func(t *testing.T) {
+		report, err := Inspect(bytes.NewReader(testutil.MakeJPEG(mainAttr, chunk2, chunk1, other, sos)))
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+
+		want := []Chunk{{guidA, 2, 2}, {guidA, 1, 2}, {guidB, 1, 1}}
+		for i, w := range want {
+			seg := report.Segments[2+i]
+			if seg.Type != KindExtendedXMP || seg.Chunk == nil || *seg.Chunk != w {
+				t.Fatalf("segment %d: got %s %+v, want %+v", 2+i, seg.Type, seg.Chunk, w)
+			}
+		}
+	})
+}
+
+const testXMPPacket = `<?xpacket begin="` + "\uFEFF" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:mm="http://ns.adobe.com/xap/1.0/mm/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:crs="http://ns.adobe.com/camera-raw-settings/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:stRef="http://ns.adobe.com/xap/1.0/sType/ResourceRef#"
+    mm:DocumentID="xmp.did:1234"
+    crs:Exposure2012="+0.50"
+    photoshop:City="Berlin"
+    exif:GPSLatitude="52,30.6N">
+   <dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li></rdf:Seq></dc:creator>
+   <dc:rights><rdf:Alt><rdf:li xml:lang="x-default">CC BY 4.0</rdf:li></rdf:Alt></dc:rights>
+   <mm:History>
+    <rdf:Seq>
+     <rdf:li mm:action="saved" mm:softwareAgent="Editor 1.0"/>
+    </rdf:Seq>
+   </mm:History>
+   <mm:DerivedFrom rdf:parseType="Resource"><stRef:documentID>xmp.did:0002</stRef:documentID></mm:DerivedFrom>
+   <photoshop:DocumentAncestors><rdf:Bag><rdf:li>xmp.did:0001</rdf:li></rdf:Bag></photoshop:DocumentAncestors>
+   <exif:GPSAltitude>345/10</exif:GPSAltitude>
+   <exif:ExposureTime>1/125</exif:ExposureTime>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+// helper: strip the test packet with the given types and return the packet
+func stripXMPPacket(t *testing.T, types ...string) string {
+	t.Helper()
+
+	seg := testutil.MakeSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+testXMPPacket))
+	got := stripBytes(t, testutil.MakeJPEG(seg, testutil.MakeSOS([]byte{0x11})), policyFor(types...))
+
+	i := bytes.Index(got, []byte("<?xpacket begin"))
+	j := bytes.LastIndex(got, []byte("?>"))
+	if i < 0 || j < i {
+		t.Fatalf("XMP packet missing from output")
+	}
+	packet := got[i : j+2]
+
+	d := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("rewritten packet is not well-formed: %v\n%s", err, packet)
+		}
+	}
+	return string(packet)
+}
+
+func TestEditXMP(t *testing.T) {
+	assertPacket := func(t *testing.T, packet string, gone, kept []string) {
+		t.Helper()
+		for _, s := range gone {
+			if strings.Contains(packet, s) {
+				t.Fatalf("expected %q to be removed:\n%s", s, packet)
+			}
+		}
+		for _, s := range kept {
+			if !strings.Contains(packet, s) {
+				t.Fatalf("expected %q to be kept:\n%s", s, packet)
+			}
+		}
+	}
+
+	t.Run("xmp:history keeps rights and creator", func(t *testing.T) {
+		packet := stripXMPPacket(t, "xmp:history")
+		assertPacket(t, packet,
+			[]string{"mm:History", "mm:DerivedFrom", "DocumentAncestors", "xmp.did:0001", "xmp.did:0002"},
+			[]string{"Jane Doe", "CC BY 4.0", `photoshop:City="Berlin"`, "crs:Exposure2012", "exif:GPSAltitude"})
+	})
+
+	t.Run("xmp:history keeps the document ID", func(t *testing.T) {
+		packet := stripXMPPacket(t, "xmp:history")
+		assertPacket(t, packet, nil, []string{`mm:DocumentID="xmp.did:1234"`, "xmlns:mm"})
+	})
+
+	t.Run("xmp:camera-raw removes the whole namespace", func(t *testing.T) {
+		packet := stripXMPPacket(t, "xmp:camera-raw")
+		assertPacket(t, packet, []string{"crs:", "camera-raw-settings"}, []string{"mm:History", "Jane Doe"})
+	})
+
+	t.Run("xmp:gps removes only GPS properties", func(t *testing.T) {
+		packet := stripXMPPacket(t, "xmp:gps")
+		assertPacket(t, packet, []string{"GPSLatitude", "GPSAltitude"}, []string{"exif:ExposureTime", "xmlns:exif"})
+	})
+
+	t.Run("Untouched parts keep their formatting", func(t *testing.T) {
+		packet := stripXMPPacket(t, "xmp:gps")
+		for _, line := range []string{
+			`   <dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li></rdf:Seq></dc:creator>`,
+			"   <exif:ExposureTime>1/125</exif:ExposureTime>\n  </rdf:Description>",
+			`<?xpacket end="w"?>`,
+		} {
+			if !strings.Contains(packet, line) {
+				t.Fatalf("expected %q unchanged:\n%s", line, packet)
+			}
+		}
+	})
+
+	t.Run("Unparseable packet is dropped", func(t *testing.T) {
+		seg := testutil.MakeSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta><rdf:RDF></x:xmpmeta>"))
+		got := stripBytes(t, testutil.MakeJPEG(seg, testutil.MakeSOS([]byte{0x11})), policyFor("xmp:history"))
+
+		if testutil.ContainsMarker(got, 0xE1) {
+			t.Fatalf("expected broken XMP packet to be removed")
+		}
+	})
+}
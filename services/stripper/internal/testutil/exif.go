@@ -0,0 +1,138 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Tag is one IFD entry of a test EXIF block. Value holds the big-endian
+// encoded value bytes.
+type Tag struct {
+	ID    uint16
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+func ASCII(id uint16, s string) Tag {
+	return Tag{ID: id, Type: 2, Count: uint32(len(s) + 1), Value: append([]byte(s), 0)}
+}
+
+func Short(id uint16, v uint16) Tag {
+	return Tag{ID: id, Type: 3, Count: 1, Value: binary.BigEndian.AppendUint16(nil, v)}
+}
+
+func Long(id uint16, v uint32) Tag {
+	return Tag{ID: id, Type: 4, Count: 1, Value: binary.BigEndian.AppendUint32(nil, v)}
+}
+
+// Rational encodes numerator/denominator pairs
+func Rational(id uint16, pairs ...uint32) Tag {
+	var v []byte
+	for _, n := range pairs {
+		v = binary.BigEndian.AppendUint32(v, n)
+	}
+	return Tag{ID: id, Type: 5, Count: uint32(len(pairs) / 2), Value: v}
+}
+
+func Undefined(id uint16, data []byte) Tag {
+	return Tag{ID: id, Type: 7, Count: uint32(len(data)), Value: data}
+}
+
+// Exif describes a big-endian EXIF block with optional Exif and GPS
+// sub-IFDs and an optional JPEG thumbnail in IFD1.
+type Exif struct {
+	IFD0      []Tag
+	Exif      []Tag
+	GPS       []Tag
+	Thumbnail []byte
+}
+
+// Payload returns the APP1 payload including the "Exif\0\0" header
+func (e Exif) Payload() []byte {
+	var b bytes.Buffer
+	b.WriteString("Exif\x00\x00")
+	b.Write(e.TIFF())
+	return b.Bytes()
+}
+
+func (e Exif) TIFF() []byte {
+	ifd0 := append([]Tag{}, e.IFD0...)
+	if len(e.Exif) > 0 {
+		ifd0 = append(ifd0, Long(0x8769, 0))
+	}
+	if len(e.GPS) > 0 {
+		ifd0 = append(ifd0, Long(0x8825, 0))
+	}
+
+	var ifd1 []Tag
+	if len(e.Thumbnail) > 0 {
+		ifd1 = []Tag{Long(0x0201, 0), Long(0x0202, uint32(len(e.Thumbnail)))}
+	}
+
+	w := &tiffBuilder{}
+	w.buf.Write([]byte{'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08})
+
+	next := w.writeIFD(ifd0)
+	if len(e.Exif) > 0 {
+		w.patch(w.valuePos[0x8769], uint32(w.buf.Len()))
+		w.writeIFD(e.Exif)
+	}
+	if len(e.GPS) > 0 {
+		w.patch(w.valuePos[0x8825], uint32(w.buf.Len()))
+		w.writeIFD(e.GPS)
+	}
+	if len(ifd1) > 0 {
+		w.patch(next, uint32(w.buf.Len()))
+		w.writeIFD(ifd1)
+		w.patch(w.valuePos[0x0201], uint32(w.buf.Len()))
+		w.buf.Write(e.Thumbnail)
+	}
+
+	return w.buf.Bytes()
+}
+
+type tiffBuilder struct {
+	buf      bytes.Buffer
+	valuePos map[uint16]int
+}
+
+func (w *tiffBuilder) writeIFD(tags []Tag) int {
+	if w.valuePos == nil {
+		w.valuePos = make(map[uint16]int)
+	}
+
+	start := w.buf.Len()
+	dataPos := start + 2 + 12*len(tags) + 4
+
+	var data bytes.Buffer
+	binary.Write(&w.buf, binary.BigEndian, uint16(len(tags)))
+	for _, t := range tags {
+		binary.Write(&w.buf, binary.BigEndian, t.ID)
+		binary.Write(&w.buf, binary.BigEndian, t.Type)
+		binary.Write(&w.buf, binary.BigEndian, t.Count)
+
+		w.valuePos[t.ID] = w.buf.Len()
+		if len(t.Value) <= 4 {
+			v := make([]byte, 4)
+			copy(v, t.Value)
+			w.buf.Write(v)
+			continue
+		}
+
+		binary.Write(&w.buf, binary.BigEndian, uint32(dataPos+data.Len()))
+		data.Write(t.Value)
+		if data.Len()%2 == 1 {
+			data.WriteByte(0)
+		}
+	}
+
+	next := w.buf.Len()
+	w.buf.Write([]byte{0, 0, 0, 0})
+	w.buf.Write(data.Bytes())
+	return next
+}
+
+func (w *tiffBuilder) patch(pos int, v uint32) {
+	binary.BigEndian.PutUint32(w.buf.Bytes()[pos:], v)
+}
@@ -42,8 +42,11 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	defer file.Close()
 
 	metadataTypes := r.Form["metadataType"]
+	gps, dates := r.FormValue("gps"), r.FormValue("dates")
 
-	if len(metadataTypes) == 0 {
+	// EXIF is removed by default, but not when the location or the dates are
+	// all that was chosen, as rewriting them needs the EXIF data
+	if len(metadataTypes) == 0 && gps == "" && dates == "" {
 		metadataTypes = []string{"EXIF"} // default
 	}
 
@@ -62,6 +65,20 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	for _, mt := range metadataTypes {
 		q.Add("metadataType", mt)
 	}
+	// The location choice is a grid size in kilometres
+	if gps != "" {
+		q.Add("metadataType", "gps:coarsen="+gps)
+	}
+	// Dates are truncated to "day" or "month"
+	if dates != "" {
+		q.Add("metadataType", "time:truncate="+dates)
+	}
+	for _, k := range r.Form["keep"] {
+		q.Add("keep", k)
+	}
+	if orientation := r.FormValue("orientation"); orientation != "" {
+		q.Set("orientation", orientation)
+	}
 	u.RawQuery = q.Encode()
 
 	stripperURL = u.String()
@@ -81,6 +98,19 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	// The list of unsupported types, or the limit the file is over, is for
+	// the user, so it is passed on
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		ct := resp.Header.Get("Content-Type")
+		if ct == "" {
+			ct = "application/problem+json"
+		}
+		w.Header().Set("Content-Type", ct)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.CopyN(w, resp.Body, 64<<10)
+		return
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		w.WriteHeader(http.StatusBadGateway)
 		io.CopyN(w, resp.Body, 1024)
@@ -5,6 +5,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 )
@@ -59,4 +60,137 @@ func TestRootHandler(t *testing.T) {
 			t.Fatalf("expected 400, got %d", rec.Code)
 		}
 	})
+	t.Run("POST /upload forwards metadata types, location, keep and orientation", func(t *testing.T) {
+		var gotQuery url.Values
+		stripper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.Query()
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte{0xFF, 0xD8, 0xFF, 0xD9})
+		}))
+		defer stripper.Close()
+		t.Setenv("STRIPPER_URL", stripper.URL+"/strip")
+
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		fw, _ := w.CreateFormFile("file", "photo.jpg")
+		fw.Write([]byte{0xFF, 0xD8, 0xFF, 0xD9})
+		_ = w.WriteField("metadataType", "EXIF")
+		_ = w.WriteField("metadataType", "XMP")
+		_ = w.WriteField("keep", "ICC")
+		_ = w.WriteField("gps", "10")
+		_ = w.WriteField("dates", "day")
+		_ = w.WriteField("orientation", "bake")
+		_ = w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if got := gotQuery["metadataType"]; len(got) != 4 || got[0] != "EXIF" || got[1] != "XMP" || got[2] != "gps:coarsen=10" || got[3] != "time:truncate=day" {
+			t.Fatalf("metadataType = %v", got)
+		}
+		if got := gotQuery.Get("keep"); got != "ICC" {
+			t.Fatalf("keep = %q", got)
+		}
+		if got := gotQuery.Get("orientation"); got != "bake" {
+			t.Fatalf("orientation = %q", got)
+		}
+	})
+	t.Run("POST /upload with only a location choice keeps EXIF", func(t *testing.T) {
+		var gotQuery url.Values
+		stripper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.Query()
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte{0xFF, 0xD8, 0xFF, 0xD9})
+		}))
+		defer stripper.Close()
+		t.Setenv("STRIPPER_URL", stripper.URL+"/strip")
+
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		fw, _ := w.CreateFormFile("file", "photo.jpg")
+		fw.Write([]byte{0xFF, 0xD8, 0xFF, 0xD9})
+		_ = w.WriteField("gps", "10")
+		_ = w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if got := gotQuery["metadataType"]; len(got) != 1 || got[0] != "gps:coarsen=10" {
+			t.Fatalf("metadataType = %v", got)
+		}
+	})
+	t.Run("POST /upload with only a dates choice keeps EXIF", func(t *testing.T) {
+		var gotQuery url.Values
+		stripper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.Query()
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte{0xFF, 0xD8, 0xFF, 0xD9})
+		}))
+		defer stripper.Close()
+		t.Setenv("STRIPPER_URL", stripper.URL+"/strip")
+
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		fw, _ := w.CreateFormFile("file", "photo.jpg")
+		fw.Write([]byte{0xFF, 0xD8, 0xFF, 0xD9})
+		_ = w.WriteField("dates", "day")
+		_ = w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if got := gotQuery["metadataType"]; len(got) != 1 || got[0] != "time:truncate=day" {
+			t.Fatalf("metadataType = %v", got)
+		}
+	})
+	t.Run("POST /upload passes unsupported types on as 422", func(t *testing.T) {
+		stripper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"type":"about:blank","title":"Unsupported metadata types","status":422,"unsupported":["exfi"]}`))
+		}))
+		defer stripper.Close()
+		t.Setenv("STRIPPER_URL", stripper.URL+"/strip")
+
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		fw, _ := w.CreateFormFile("file", "photo.jpg")
+		fw.Write([]byte{0xFF, 0xD8, 0xFF, 0xD9})
+		_ = w.WriteField("metadataType", "exfi")
+		_ = w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("expected application/problem+json, got %q", ct)
+		}
+		if rec.Header().Get("Content-Disposition") != "" || !strings.Contains(rec.Body.String(), `"exfi"`) {
+			t.Fatalf("expected the list instead of a download, got %q", rec.Body.String())
+		}
+	})
 }
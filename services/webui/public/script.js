@@ -2,6 +2,7 @@
     const form = document.querySelector('form');
     const input = document.getElementById('file');
     const chosen = document.getElementById('chosen');
+    const errors = document.getElementById('errors');
 
     input.addEventListener('change', () => {
         const f = input.files && input.files[0];
@@ -16,11 +17,65 @@
         chosen.hidden = false;
     });
 
-    form.addEventListener('submit', () => {
-        setTimeout(() => {
-            form.reset();
-            chosen.hidden = true;
-            chosen.textContent = '';
-        }, 500);
+    function showError(message, items) {
+        errors.textContent = message;
+        if (items && items.length) {
+            const list = document.createElement('ul');
+            for (const item of items) {
+                const li = document.createElement('li');
+                li.textContent = item;
+                list.appendChild(li);
+            }
+            errors.appendChild(list);
+        }
+        errors.hidden = false;
+    }
+
+    function download(blob, response) {
+        const disposition = response.headers.get('Content-Disposition') || '';
+        const match = disposition.match(/filename="([^"]+)"/);
+
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(blob);
+        link.download = match ? match[1] : 'cleaned.jpg';
+        document.body.appendChild(link);
+        link.click();
+        link.remove();
+        setTimeout(() => URL.revokeObjectURL(link.href), 1000);
+    }
+
+    // The form is sent from here so a rejected request shows why instead of
+    // downloading an error as the cleaned file
+    form.addEventListener('submit', async (event) => {
+        event.preventDefault();
+        errors.hidden = true;
+        errors.textContent = '';
+
+        let response;
+        try {
+            response = await fetch(form.action, { method: 'POST', body: new FormData(form) });
+        } catch (err) {
+            showError('The cleaner could not be reached. Please try again.');
+            return;
+        }
+
+        if (response.status === 422) {
+            const body = await response.json().catch(() => ({}));
+            if (body.unsupported) {
+                showError('The file was not cleaned. These options are not supported:', body.unsupported);
+            } else {
+                showError(`The file was not cleaned: ${body.detail || response.statusText}`);
+            }
+            return;
+        }
+        if (!response.ok) {
+            showError(`The file was not cleaned: ${(await response.text()).trim() || response.statusText}`);
+            return;
+        }
+
+        download(await response.blob(), response);
+        form.reset();
+        chosen.hidden = true;
+        chosen.textContent = '';
     });
 })();